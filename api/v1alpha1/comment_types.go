@@ -1,17 +1,195 @@
 package v1alpha1
 
-import corev1 "k8s.io/api/core/v1"
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
 
 type KubernetesConfig struct {
-	Image           string                       `json:"image"`
+	// Image redis镜像, RedisSingle和RedisCluster为空时使用engine对应的默认镜像
+	Image           string                       `json:"image,omitempty"`
 	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
 	Resource        *corev1.ResourceRequirements `json:"resources,omitempty"`
 }
 
+// RedisService redis对外访问的service配置
+type RedisService struct {
+	// Type service类型, RedisCluster为NodePort或LoadBalancer时会给每个pod创建对外的service,
+	// 并把对外地址设置为cluster-announce-ip/port, 集群外的客户端才能访问重定向的地址
+	// +kubebuilder:validation:Enum=ClusterIP;NodePort;LoadBalancer
+	Type string `json:"type,omitempty"`
+	// Annotations 追加到service上的注解, 比如云厂商的负载均衡配置
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// LoadBalancerSourceRanges 类型为LoadBalancer时允许访问的来源网段
+	LoadBalancerSourceRanges []string `json:"loadBalancerSourceRanges,omitempty"`
+}
+
 type RedisConfig struct {
+	// AdditionalRedisConfig ConfigMap名称, 其中redis-external.conf的内容会追加到redis配置中
 	AdditionalRedisConfig *string `json:"additionalRedisConfig,omitempty"`
+	// MaxMemoryPercent maxmemory占容器内存limit的百分比, 剩余部分留给fork时的写时复制和连接缓冲区, 默认75;
+	// 没有设置内存limit时不生成maxmemory, additionalRedisConfig中的maxmemory优先
+	// +kubebuilder:validation:Minimum=10
+	// +kubebuilder:validation:Maximum=100
+	MaxMemoryPercent *int32 `json:"maxmemoryPercent,omitempty"`
+	// MaxMemoryPolicy 内存达到maxmemory时的淘汰策略
+	// +kubebuilder:validation:Enum=noeviction;allkeys-lru;allkeys-lfu;allkeys-random;volatile-lru;volatile-lfu;volatile-random;volatile-ttl
+	MaxMemoryPolicy string `json:"maxmemoryPolicy,omitempty"`
+}
+
+const (
+	// RedisConfigPathOnline 参数通过CONFIG SET在线生效
+	RedisConfigPathOnline = "Online"
+	// RedisConfigPathRollout 参数需要重启, 通过滚动更新pod生效
+	RedisConfigPathRollout = "Rollout"
+)
+
+// ConditionReconciled 最近一次调谐是否成功的condition类型
+const ConditionReconciled = "Reconciled"
+
+// ConditionReplicaPlacement RedisCluster的副本是否都在master以外的节点和可用区
+const ConditionReplicaPlacement = "ReplicaPlacement"
+
+// RedisConfigStatus 记录最近一次配置变更的生效方式
+type RedisConfigStatus struct {
+	// Path 最近一次变更的生效方式, Online或Rollout
+	Path string `json:"path,omitempty"`
+	// OnlineParameters 最近一次通过CONFIG SET修改的参数
+	OnlineParameters []string `json:"onlineParameters,omitempty"`
+	// RestartParameters 配置中需要重启才能生效的参数
+	RestartParameters []string `json:"restartParameters,omitempty"`
+	// RestartHash 需要重启的参数的hash, 与pod模板上的注解一致
+	RestartHash    string       `json:"restartHash,omitempty"`
+	LastUpdateTime *metav1.Time `json:"lastUpdateTime,omitempty"`
 }
 
+// Storage 增大volumeClaimTemplate的容量时, operator会在StorageClass允许扩容的情况下扩容已有的PVC并重建statefulSet
 type Storage struct {
-	VolumeClaimTemplate corev1.PersistentVolumeClaim `json:"volumeClaimTemplate,omitempty"`
+	VolumeClaimTemplate                  corev1.PersistentVolumeClaim `json:"volumeClaimTemplate,omitempty"`
+	PersistentVolumeClaimRetentionPolicy *PVCRetentionPolicy          `json:"persistentVolumeClaimRetentionPolicy,omitempty"`
+}
+
+const (
+	RedisEngineRedis  = "redis"
+	RedisEngineValkey = "valkey"
+	RedisEngineKeyDB  = "keydb"
+)
+
+const (
+	PersistenceModeNone = "None"
+	PersistenceModeRDB  = "RDB"
+	PersistenceModeAOF  = "AOF"
+	PersistenceModeBoth = "Both"
+)
+
+// Persistence redis持久化方式, 渲染到生成的配置中; RDB、AOF和Both需要配置storage
+type Persistence struct {
+	// Mode None关闭持久化, RDB只做快照, AOF只写append only文件, Both两者都开启
+	// +kubebuilder:validation:Enum=None;RDB;AOF;Both
+	Mode string `json:"mode"`
+	// Save RDB快照策略, 每一项为"<秒> <修改次数>", 例如"900 1"; 为空时使用镜像默认的策略
+	Save []string `json:"save,omitempty"`
+	// AppendFsync AOF刷盘策略, 默认everysec
+	// +kubebuilder:validation:Enum=always;everysec;no
+	AppendFsync string `json:"appendfsync,omitempty"`
+	// AOFUseRDBPreamble AOF重写时是否使用RDB格式的前缀
+	AOFUseRDBPreamble *bool `json:"aofUseRdbPreamble,omitempty"`
+}
+
+const (
+	DeletionPolicyRetain   = "Retain"
+	DeletionPolicyDelete   = "Delete"
+	DeletionPolicySnapshot = "Snapshot"
+)
+
+const (
+	PVCRetentionRetain = "Retain"
+	PVCRetentionDelete = "Delete"
+)
+
+// PVCRetentionPolicy 与statefulSet的persistentVolumeClaimRetentionPolicy含义相同, 由operator实现
+type PVCRetentionPolicy struct {
+	// WhenDeleted 删除CR时是否删除PVC, 默认Retain; RedisSingle未设置时保持原有行为, 由finalizer删除PVC
+	// +kubebuilder:validation:Enum=Retain;Delete
+	WhenDeleted string `json:"whenDeleted,omitempty"`
+	// WhenScaled 缩容后是否删除多余pod的PVC, 默认Retain
+	// +kubebuilder:validation:Enum=Retain;Delete
+	WhenScaled string `json:"whenScaled,omitempty"`
+}
+
+// BackupStorage S3兼容的对象存储, 比如MinIO
+type BackupStorage struct {
+	// Endpoint 对象存储地址, 例如 http://minio.minio:9000
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Prefix   string `json:"prefix,omitempty"`
+	// Region 默认us-east-1
+	Region string `json:"region,omitempty"`
+	// CredentialsSecret 包含AWS_ACCESS_KEY_ID和AWS_SECRET_ACCESS_KEY的secret
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// BackupSchedule 定时备份配置
+type BackupSchedule struct {
+	// Schedule cron表达式, 例如 "0 3 * * *"
+	Schedule string        `json:"schedule"`
+	Storage  BackupStorage `json:"storage"`
+	// KeepLast 保留最近的备份个数, 为空时不清理
+	// +kubebuilder:validation:Minimum=1
+	KeepLast *int32 `json:"keepLast,omitempty"`
+}
+
+// RestoreFrom 创建时从备份恢复数据, 只在数据目录为空时下载, 需要同时配置storage
+type RestoreFrom struct {
+	// BackupName 同namespace下状态为Completed的RedisBackup
+	BackupName string `json:"backupName"`
+	// Image 下载备份使用的镜像, 需要包含sh和mc, 默认minio/mc
+	Image string `json:"image,omitempty"`
+}
+
+// RedisExporter redis_exporter sidecar配置, 配置后每个redis pod都会带上exporter
+type RedisExporter struct {
+	// Image 默认oliver006/redis_exporter
+	Image           string                       `json:"image,omitempty"`
+	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
+	Resources       *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Port 默认9121
+	Port           *int32                `json:"port,omitempty"`
+	ServiceMonitor *ServiceMonitorConfig `json:"serviceMonitor,omitempty"`
+	PrometheusRule *PrometheusRuleConfig `json:"prometheusRule,omitempty"`
+}
+
+// ServiceMonitorConfig 创建prometheus-operator的ServiceMonitor
+type ServiceMonitorConfig struct {
+	// Interval 采集间隔, 默认30s
+	Interval string `json:"interval,omitempty"`
+	// Labels prometheus用来选择ServiceMonitor的标签
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PrometheusRuleConfig 创建带默认告警的PrometheusRule
+type PrometheusRuleConfig struct {
+	// Labels prometheus用来选择PrometheusRule的标签
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// PodDisruptionBudget 配置后创建PDB, minAvailable和maxUnavailable只能设置一个, 都不设置时maxUnavailable为1
+type PodDisruptionBudget struct {
+	MinAvailable   *intstr.IntOrString `json:"minAvailable,omitempty"`
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+}
+
+// PodScheduling pod调度和运行相关配置
+type PodScheduling struct {
+	Affinity                  *corev1.Affinity                  `json:"affinity,omitempty"`
+	Tolerations               []corev1.Toleration               `json:"tolerations,omitempty"`
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	PriorityClassName         string                            `json:"priorityClassName,omitempty"`
+	SecurityContext           *corev1.PodSecurityContext        `json:"securityContext,omitempty"`
+	ServiceAccountName        string                            `json:"serviceAccountName,omitempty"`
+	ImagePullSecrets          []corev1.LocalObjectReference     `json:"imagePullSecrets,omitempty"`
+	// PodLabels 额外的pod标签, 不影响statefulSet的selector
+	PodLabels      map[string]string `json:"podLabels,omitempty"`
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
 }
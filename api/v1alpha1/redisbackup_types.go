@@ -0,0 +1,99 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+redis 备份实现, 对每个master执行BGSAVE并把dump.rdb上传到对象存储
+
+*/
+
+const (
+	BackupPhaseRunning   = "Running"
+	BackupPhaseCompleted = "Completed"
+	BackupPhaseFailed    = "Failed"
+)
+
+// BackupSource 需要备份的redis
+type BackupSource struct {
+	// +kubebuilder:validation:Enum=RedisSingle;RedisCluster
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// RedisBackupSpec defines the desired state of RedisBackup
+type RedisBackupSpec struct {
+	Source  BackupSource  `json:"source"`
+	Storage BackupStorage `json:"storage"`
+}
+
+// BackupRecord 一个master的备份文件
+type BackupRecord struct {
+	PodName string `json:"podName"`
+	Key     string `json:"key"`
+	Size    int64  `json:"size"`
+	// Slots 集群模式下该master负责的slot, 格式同CLUSTER NODES, 例如 "0-5460"
+	Slots []string `json:"slots,omitempty"`
+}
+
+// BackupSave 已经执行BGSAVE、还没有上传的master
+type BackupSave struct {
+	PodName string `json:"podName"`
+	// LastSaveTime 执行BGSAVE前的rdb_last_save_time, 变化后表示本次BGSAVE完成
+	LastSaveTime string `json:"lastSaveTime"`
+}
+
+// RedisBackupStatus defines the observed state of RedisBackup
+type RedisBackupStatus struct {
+	Phase          string         `json:"phase,omitempty"`
+	Message        string         `json:"message,omitempty"`
+	StartTime      *metav1.Time   `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time   `json:"completionTime,omitempty"`
+	Records        []BackupRecord `json:"records,omitempty"`
+	// Deadline BGSAVE和上传需要在该时间前完成, 否则备份失败
+	Deadline *metav1.Time `json:"deadline,omitempty"`
+	// Saves 正在执行BGSAVE的master
+	Saves []BackupSave `json:"saves,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// RedisBackup is the Schema for the redisbackups API
+type RedisBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RedisBackupSpec   `json:"spec,omitempty"`
+	Status RedisBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RedisBackupList contains a list of RedisBackup
+type RedisBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RedisBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RedisBackup{}, &RedisBackupList{})
+}
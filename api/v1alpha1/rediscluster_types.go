@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -25,13 +26,45 @@ import (
 
 type RedisLeader struct {
 	// +kubebuilder:validation:Minimum=3
-	Replicas    *int32       `json:"replicas,omitempty"`
-	RedisConfig *RedisConfig `json:"redisConfig,omitempty"`
+	Replicas            *int32               `json:"replicas,omitempty"`
+	RedisConfig         *RedisConfig         `json:"redisConfig,omitempty"`
+	PodDisruptionBudget *PodDisruptionBudget `json:"pdb,omitempty"`
+	PodScheduling       *PodScheduling       `json:"podScheduling,omitempty"`
+
+	// Image, ImagePullPolicy和Resource为空时使用kubernetesConfig
+	Image           string                       `json:"image,omitempty"`
+	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
+	Resource        *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Storage和NodeSelector为空时使用集群的配置
+	Storage      *Storage          `json:"storage,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
 }
 
 type RedisFollower struct {
-	Replicas    *int32       `json:"replicas,omitempty"`
-	RedisConfig *RedisConfig `json:"redisConfig,omitempty"`
+	Replicas            *int32               `json:"replicas,omitempty"`
+	RedisConfig         *RedisConfig         `json:"redisConfig,omitempty"`
+	PodDisruptionBudget *PodDisruptionBudget `json:"pdb,omitempty"`
+	PodScheduling       *PodScheduling       `json:"podScheduling,omitempty"`
+
+	// Image, ImagePullPolicy和Resource为空时使用kubernetesConfig
+	Image           string                       `json:"image,omitempty"`
+	ImagePullPolicy corev1.PullPolicy            `json:"imagePullPolicy,omitempty"`
+	Resource        *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// Storage和NodeSelector为空时使用集群的配置
+	Storage      *Storage          `json:"storage,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// RedisClusterTopology 多可用区部署, 每个角色的pod按可用区均匀分布, master分散到不同可用区, 副本放在master以外的可用区
+type RedisClusterTopology struct {
+	// ZoneLabelKey 节点上表示可用区的标签, 默认topology.kubernetes.io/zone
+	ZoneLabelKey string `json:"zoneLabelKey,omitempty"`
+	// MaxSkew 同一角色在各可用区之间pod个数的最大差值, 默认1
+	// +kubebuilder:validation:Minimum=1
+	MaxSkew *int32 `json:"maxSkew,omitempty"`
+	// WhenUnsatisfiable 无法满足均匀分布时的调度策略, 默认DoNotSchedule
+	// +kubebuilder:validation:Enum=DoNotSchedule;ScheduleAnyway
+	WhenUnsatisfiable corev1.UnsatisfiableConstraintAction `json:"whenUnsatisfiable,omitempty"`
 }
 
 // RedisClusterSpec defines the desired state of RedisCluster
@@ -43,14 +76,55 @@ type RedisClusterSpec struct {
 	RedisLeader      RedisLeader       `json:"redisLeader,omitempty"`
 	RedisFollower    RedisFollower     `json:"redisFollower,omitempty"`
 	Storage          *Storage          `json:"storage,omitempty"`
+	Persistence      *Persistence      `json:"persistence,omitempty"`
 	NodeSelector     map[string]string `json:"nodeSelector,omitempty"`
+	Backup           *BackupSchedule   `json:"backup,omitempty"`
+	RestoreFrom      *RestoreFrom      `json:"restoreFrom,omitempty"`
+	RedisExporter    *RedisExporter    `json:"redisExporter,omitempty"`
+	Service          *RedisService     `json:"service,omitempty"`
+	// ReplicasPerMaster 每个master的副本数, 设置后follower的个数为leader个数乘以该值, 忽略redisFollower.replicas
+	// +kubebuilder:validation:Minimum=0
+	ReplicasPerMaster *int32 `json:"replicasPerMaster,omitempty"`
+	// Engine 兼容redis协议的服务端实现, 决定默认镜像、启动命令、配置差异和集群管理使用的命令行工具
+	// +kubebuilder:validation:Enum=redis;valkey;keydb
+	// +kubebuilder:default=redis
+	Engine string `json:"engine,omitempty"`
+	// Topology 多可用区部署, 设置后按可用区分散pod、master和副本, 一个可用区故障不会丢失slot
+	Topology *RedisClusterTopology `json:"topology,omitempty"`
+	// DeletionPolicy 删除时数据的处理方式: Retain保留PVC, Delete删除PVC, Snapshot先按backup.storage备份再删除PVC;
+	// 未设置时按storage.persistentVolumeClaimRetentionPolicy处理
+	// +kubebuilder:validation:Enum=Retain;Delete;Snapshot
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
 }
 
+const (
+	// RedisClusterPhaseProvisioning 创建或更新statefulSet、service等资源
+	RedisClusterPhaseProvisioning = "Provisioning"
+	// RedisClusterPhaseWaitingForPods 等待leader和follower的pod全部就绪
+	RedisClusterPhaseWaitingForPods = "WaitingForPods"
+	// RedisClusterPhaseBootstrapping 用leader创建集群或从备份恢复
+	RedisClusterPhaseBootstrapping = "Bootstrapping"
+	// RedisClusterPhaseReplicating follower加入集群
+	RedisClusterPhaseReplicating = "Replicating"
+	// RedisClusterPhaseReady 集群节点齐全且状态正常
+	RedisClusterPhaseReady = "Ready"
+	// RedisClusterPhaseRepairing 故障切换、滚动升级或重新分配主从
+	RedisClusterPhaseRepairing = "Repairing"
+)
+
 // RedisClusterStatus defines the observed state of RedisCluster
 type RedisClusterStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
-	RedisCluster RedisCluster `json:"redisCluster,omitempty"`
+	// LeaderConfig/FollowerConfig 各角色配置变更的生效方式
+	LeaderConfig   *RedisConfigStatus `json:"leaderConfig,omitempty"`
+	FollowerConfig *RedisConfigStatus `json:"followerConfig,omitempty"`
+	// Phase 最近一次调谐停留的阶段
+	Phase string `json:"phase,omitempty"`
+	// RedisVersion 从INFO server检测到的最低redis版本, 7.x会开启ACL文件和hostname等特性
+	RedisVersion string `json:"redisVersion,omitempty"`
+	// Conditions 最近一次调谐的结果
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -61,8 +135,8 @@ type RedisCluster struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
-	Spec   RedisClusterSpec `json:"spec,omitempty"`
-	Status RedisClusterSpec `json:"status,omitempty"`
+	Spec   RedisClusterSpec   `json:"spec,omitempty"`
+	Status RedisClusterStatus `json:"status,omitempty"`
 }
 
 //+kubebuilder:object:root=true
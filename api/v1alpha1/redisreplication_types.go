@@ -0,0 +1,71 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+redis 主从复制实现, 一个master加若干个replica, 配合RedisSentinel做高可用
+
+*/
+
+// RedisReplicationSpec defines the desired state of RedisReplication
+type RedisReplicationSpec struct {
+	// +kubebuilder:validation:Minimum=1
+	Size             *int32            `json:"size"`
+	KubernetesConfig KubernetesConfig  `json:"kubernetesConfig"`
+	RedisConfig      *RedisConfig      `json:"redisConfig,omitempty"`
+	Storage          *Storage          `json:"storage,omitempty"`
+	NodeSelector     map[string]string `json:"nodeSelector,omitempty"`
+}
+
+// RedisReplicationStatus defines the observed state of RedisReplication
+type RedisReplicationStatus struct {
+	// MasterNode 当前master所在的pod
+	MasterNode string `json:"masterNode,omitempty"`
+	// Config 配置变更的生效方式
+	Config *RedisConfigStatus `json:"config,omitempty"`
+	// Conditions 最近一次调谐的结果
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// RedisReplication is the Schema for the redisreplications API
+type RedisReplication struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RedisReplicationSpec   `json:"spec,omitempty"`
+	Status RedisReplicationStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RedisReplicationList contains a list of RedisReplication
+type RedisReplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RedisReplication `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RedisReplication{}, &RedisReplicationList{})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+redis sentinel 实现, 监控RedisReplication并在master故障时自动切换
+
+*/
+
+// RedisSentinelConfig sentinel监控的主从组配置
+type RedisSentinelConfig struct {
+	// RedisReplicationName 被监控的RedisReplication, 必须在同一个namespace
+	RedisReplicationName string `json:"redisReplicationName"`
+	// MasterGroupName SENTINEL MONITOR使用的组名, 默认mymaster
+	MasterGroupName string `json:"masterGroupName,omitempty"`
+	// Quorum 判定master客观下线需要的sentinel数量, 默认过半
+	// +kubebuilder:validation:Minimum=1
+	Quorum                *int32 `json:"quorum,omitempty"`
+	DownAfterMilliseconds *int32 `json:"downAfterMilliseconds,omitempty"`
+	FailoverTimeout       *int32 `json:"failoverTimeout,omitempty"`
+	ParallelSyncs         *int32 `json:"parallelSyncs,omitempty"`
+}
+
+// RedisSentinelSpec defines the desired state of RedisSentinel
+type RedisSentinelSpec struct {
+	// +kubebuilder:validation:Minimum=3
+	Size                *int32              `json:"size"`
+	KubernetesConfig    KubernetesConfig    `json:"kubernetesConfig"`
+	RedisSentinelConfig RedisSentinelConfig `json:"redisSentinelConfig"`
+	NodeSelector        map[string]string   `json:"nodeSelector,omitempty"`
+}
+
+// RedisSentinelStatus defines the observed state of RedisSentinel
+type RedisSentinelStatus struct {
+	// MasterAddress sentinel选出的master地址
+	MasterAddress string `json:"masterAddress,omitempty"`
+	// MasterNode master所在的pod
+	MasterNode string `json:"masterNode,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// RedisSentinel is the Schema for the redissentinels API
+type RedisSentinel struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RedisSentinelSpec   `json:"spec,omitempty"`
+	Status RedisSentinelStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RedisSentinelList contains a list of RedisSentinel
+type RedisSentinelList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RedisSentinel `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RedisSentinel{}, &RedisSentinelList{})
+}
@@ -35,6 +35,22 @@ type RedisSingleSpec struct {
 	KubernetesConfig KubernetesConfig `json:"kubernetesConfig"`
 	RedisConfig      *RedisConfig     `json:"redisConfig,omitempty"`
 	Storage          *Storage         `json:"storage,omitempty"`
+	Persistence      *Persistence     `json:"persistence,omitempty"`
+	Backup           *BackupSchedule  `json:"backup,omitempty"`
+	RestoreFrom      *RestoreFrom     `json:"restoreFrom,omitempty"`
+	RedisExporter    *RedisExporter   `json:"redisExporter,omitempty"`
+	Service          *RedisService    `json:"service,omitempty"`
+	// Engine 兼容redis协议的服务端实现, 决定默认镜像、启动命令、配置差异和集群管理使用的命令行工具
+	// +kubebuilder:validation:Enum=redis;valkey;keydb
+	// +kubebuilder:default=redis
+	Engine string `json:"engine,omitempty"`
+	// PodDisruptionBudget 单例只有一个pod, 设置后会阻止驱逐, 需要谨慎配置
+	PodDisruptionBudget *PodDisruptionBudget `json:"pdb,omitempty"`
+	PodScheduling       *PodScheduling       `json:"podScheduling,omitempty"`
+	// DeletionPolicy 删除时数据的处理方式: Retain保留PVC, Delete删除PVC, Snapshot先按backup.storage备份再删除PVC;
+	// 未设置时按storage.persistentVolumeClaimRetentionPolicy处理
+	// +kubebuilder:validation:Enum=Retain;Delete;Snapshot
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
 }
 
 // RedisSingleStatus defines the observed state of RedisSingle
@@ -42,6 +58,12 @@ type RedisSingleStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	Redis RedisSingleSpec `json:"redis,omitempty"`
+	// Config 配置变更的生效方式
+	Config *RedisConfigStatus `json:"config,omitempty"`
+	// Conditions 最近一次调谐的结果
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// RedisVersion 从INFO server检测到的redis版本, 7.x会开启ACL文件等特性
+	RedisVersion string `json:"redisVersion,omitempty"`
 }
 
 //+kubebuilder:object:root=true
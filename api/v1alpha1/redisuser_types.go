@@ -0,0 +1,86 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+/**
+redis ACL用户, 在目标redis的每个节点上执行ACL SETUSER, 删除CR时执行ACL DELUSER
+
+*/
+
+// RedisUserTarget 用户所在的redis
+type RedisUserTarget struct {
+	// +kubebuilder:validation:Enum=RedisSingle;RedisCluster
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// RedisUserPasswordSecret 存放用户密码的secret
+type RedisUserPasswordSecret struct {
+	Name string `json:"name"`
+	// Key secret中密码的key, 默认为password
+	Key string `json:"key,omitempty"`
+}
+
+// RedisUserSpec defines the desired state of RedisUser
+type RedisUserSpec struct {
+	Redis RedisUserTarget `json:"redis"`
+	// Username redis中的用户名, 默认为CR的名称; operator使用default用户连接redis, 不能设置为default
+	Username string `json:"username,omitempty"`
+	// PasswordSecret 为空时用户不需要密码(nopass)
+	PasswordSecret *RedisUserPasswordSecret `json:"passwordSecret,omitempty"`
+	// Rules ACL规则, 例如 "~app:*", "+@read", "-flushall", 每次调谐都会reset后重新设置
+	Rules []string `json:"rules,omitempty"`
+	// Disabled 为true时用户被禁用(off), 已有连接不受影响
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+// RedisUserStatus defines the observed state of RedisUser
+type RedisUserStatus struct {
+	// Nodes 已经设置了该用户的pod
+	Nodes []string `json:"nodes,omitempty"`
+	// Conditions 最近一次调谐的结果
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+
+// RedisUser is the Schema for the redisusers API
+type RedisUser struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RedisUserSpec   `json:"spec,omitempty"`
+	Status RedisUserStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RedisUserList contains a list of RedisUser
+type RedisUserList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []RedisUser `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&RedisUser{}, &RedisUserList{})
+}
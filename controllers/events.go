@@ -0,0 +1,156 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+	"github.com/yylover/memcached-operator/k8sutil"
+)
+
+// Event和Condition的原因
+const (
+	eventReasonCreated           = "Created"
+	eventReasonScaled            = "Scaled"
+	eventReasonFailover          = "Failover"
+	eventReasonRepaired          = "Repaired"
+	eventReasonBackupCompleted   = "BackupCompleted"
+	eventReasonBackupFailed      = "BackupFailed"
+	eventReasonReconcileFailed   = "ReconcileFailed"
+	eventReasonReconciled        = "Reconciled"
+	eventReasonPlacementOK       = "PlacementSatisfied"
+	eventReasonPlacementDegraded = "PlacementDegraded"
+)
+
+// redisReconcileError 带有失败原因的调谐错误, 原因用于Event和Condition
+type redisReconcileError struct {
+	reason string
+	err    error
+}
+
+func (e *redisReconcileError) Error() string {
+	return e.err.Error()
+}
+
+func (e *redisReconcileError) Unwrap() error {
+	return e.err
+}
+
+// reconcileError 给错误加上失败原因, err为nil时返回nil
+func reconcileError(reason string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redisReconcileError{reason: reason, err: err}
+}
+
+// statefulSetError statefulSet调谐失败的原因, PVC扩容失败单独标记
+func statefulSetError(err error) error {
+	var expansionErr *k8sutil.StorageExpansionError
+	if errors.As(err, &expansionErr) {
+		return reconcileError("StorageExpansionFailed", err)
+	}
+	return reconcileError("StatefulSetFailed", err)
+}
+
+// recordReconcileResult 根据调谐结果更新Reconciled condition, 失败时记录Warning事件.
+// 返回调谐的错误, 由controller-runtime按指数退避重试
+func recordReconcileResult(ctx context.Context, cl client.Client, recorder record.EventRecorder, obj client.Object, conditions *[]metav1.Condition, err error) error {
+	condition := metav1.Condition{
+		Type:               testopv1alpha1.ConditionReconciled,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: obj.GetGeneration(),
+		Reason:             eventReasonReconciled,
+		Message:            "redis resources are reconciled",
+	}
+	if err != nil {
+		reason := eventReasonReconcileFailed
+		var reconcileErr *redisReconcileError
+		if errors.As(err, &reconcileErr) {
+			reason = reconcileErr.reason
+		}
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = reason
+		condition.Message = err.Error()
+		recorder.Event(obj, corev1.EventTypeWarning, reason, err.Error())
+	}
+
+	previous := append([]metav1.Condition(nil), *conditions...)
+	meta.SetStatusCondition(conditions, condition)
+	if equality.Semantic.DeepEqual(previous, *conditions) {
+		return err
+	}
+	if updateErr := cl.Status().Update(ctx, obj); updateErr != nil {
+		ctrllog.FromContext(ctx).Error(updateErr, "update condition failed")
+		if err == nil {
+			return updateErr
+		}
+	}
+	return err
+}
+
+// getPreviousStatefulSet 获取调谐前的statefulSet, 不存在时返回nil
+func getPreviousStatefulSet(ctx context.Context, cl client.Client, namespace, name string) (*appsv1.StatefulSet, error) {
+	stateful := &appsv1.StatefulSet{}
+	if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, stateful); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return stateful, nil
+}
+
+// recordStatefulSetChange 对比调谐前的statefulSet, 记录创建或扩缩容事件
+func recordStatefulSetChange(recorder record.EventRecorder, obj client.Object, previous *appsv1.StatefulSet, name string, replicas int32) {
+	if previous == nil {
+		recorder.Eventf(obj, corev1.EventTypeNormal, eventReasonCreated, "StatefulSet %s created with %d replicas", name, replicas)
+		return
+	}
+	if previous.Spec.Replicas != nil && *previous.Spec.Replicas != replicas {
+		recorder.Eventf(obj, corev1.EventTypeNormal, eventReasonScaled, "StatefulSet %s scaled from %d to %d replicas", name, *previous.Spec.Replicas, replicas)
+	}
+}
+
+// recordReplicaPlacement 根据主从分配满足的规则更新ReplicaPlacement condition, 退化为宽松规则时记录Warning事件,
+// 只在condition变化时更新status和记录事件
+func recordReplicaPlacement(ctx context.Context, cl client.Client, recorder record.EventRecorder, instance *testopv1alpha1.RedisCluster, rule string) error {
+	if rule == "" {
+		return nil
+	}
+	condition := metav1.Condition{
+		Type:               testopv1alpha1.ConditionReplicaPlacement,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: instance.GetGeneration(),
+		Reason:             eventReasonPlacementOK,
+		Message:            "every replica is on a different node and zone from its master",
+	}
+	if rule != k8sutil.RedisPlacementNodeAndZone {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = eventReasonPlacementDegraded
+		condition.Message = "replicas share the zone with their master"
+		if rule == k8sutil.RedisPlacementAny {
+			condition.Message = "replicas share the node with their master"
+		}
+	}
+	previous := append([]metav1.Condition(nil), instance.Status.Conditions...)
+	meta.SetStatusCondition(&instance.Status.Conditions, condition)
+	if equality.Semantic.DeepEqual(previous, instance.Status.Conditions) {
+		return nil
+	}
+	if condition.Status == metav1.ConditionFalse {
+		recorder.Event(instance, corev1.EventTypeWarning, condition.Reason, condition.Message)
+	}
+	return cl.Status().Update(ctx, instance)
+}
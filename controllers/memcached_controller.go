@@ -26,6 +26,7 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -39,6 +40,8 @@ import (
 type MemcachedReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Recorder 在CR上记录创建失败事件
+	Recorder record.EventRecorder
 }
 
 //用于生成rbac访问控制
@@ -47,6 +50,7 @@ type MemcachedReconciler struct {
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=memcacheds/finalizers,verbs=update
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -89,7 +93,10 @@ func (r *MemcachedReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			err1 := r.Client.Create(ctx, dep)
 			if err1 != nil {
 				log.Error(err1, "create deployment failed")
+				r.Recorder.Event(memcached, corev1.EventTypeWarning, eventReasonReconcileFailed, err1.Error())
+				return ctrl.Result{}, err1
 			}
+			r.Recorder.Eventf(memcached, corev1.EventTypeNormal, eventReasonCreated, "Deployment %s created with %d replicas", dep.Name, memcached.Spec.Size)
 			//重新调度一次
 			log.Info("create deployment success， requeued ")
 			return ctrl.Result{Requeue: true}, nil
@@ -0,0 +1,134 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/yylover/memcached-operator/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+)
+
+// RedisBackupReconciler reconciles a RedisBackup object
+type RedisBackupReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Config 用于在pod中exec执行命令
+	Config *rest.Config
+	// Recorder 在CR上记录备份完成或失败事件
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisbackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisbackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisbackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods;pods/exec,verbs=get;list;watch;create
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+// A RedisBackup runs once: every master is saved with BGSAVE and its RDB file
+// is uploaded to the bucket. BGSAVE runs in the background and is checked again
+// on requeue until the deadline in status. The uploaded objects are removed with the CR.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+func (r *RedisBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	log.Info("redis-backup newcomming")
+
+	backup := &testopv1alpha1.RedisBackup{}
+	err := r.Client.Get(ctx, req.NamespacedName, backup)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("redis-backup object cannot find")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "get redis-backup object failed")
+		return ctrl.Result{}, err
+	}
+
+	if backup.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, k8sutil.HandleRedisBackupFinalizer(ctx, backup, r.Client)
+	}
+	if err := k8sutil.AddRedisBackupFinalizer(ctx, backup, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if backup.Status.Phase == testopv1alpha1.BackupPhaseCompleted || backup.Status.Phase == testopv1alpha1.BackupPhaseFailed {
+		return ctrl.Result{}, nil
+	}
+
+	if backup.Status.Phase == "" {
+		now := metav1.Now()
+		deadline := metav1.NewTime(now.Add(k8sutil.BackupTimeout))
+		backup.Status.Phase = testopv1alpha1.BackupPhaseRunning
+		backup.Status.StartTime = &now
+		backup.Status.Deadline = &deadline
+		if err := r.Status().Update(ctx, backup); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+
+	//BGSAVE在后台执行, 没有完成时稍后再检查
+	done, err := k8sutil.ReconcileRedisBackup(ctx, backup, r.Client, r.Config)
+	if err == nil && !done {
+		if err := r.Status().Update(ctx, backup); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	}
+	completionTime := metav1.Now()
+	backup.Status.CompletionTime = &completionTime
+	backup.Status.Saves = nil
+	if err != nil {
+		log.Error(err, "redis backup failed")
+		backup.Status.Phase = testopv1alpha1.BackupPhaseFailed
+		backup.Status.Message = err.Error()
+		r.Recorder.Event(backup, corev1.EventTypeWarning, eventReasonBackupFailed, err.Error())
+	} else {
+		backup.Status.Phase = testopv1alpha1.BackupPhaseCompleted
+		backup.Status.Message = ""
+		r.Recorder.Eventf(backup, corev1.EventTypeNormal, eventReasonBackupCompleted, "%d redis masters backed up", len(backup.Status.Records))
+	}
+	if err := r.Status().Update(ctx, backup); err != nil {
+		log.Error(err, "update status failed")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RedisBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&testopv1alpha1.RedisBackup{}).
+		Complete(r)
+}
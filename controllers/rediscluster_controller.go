@@ -20,13 +20,21 @@ import (
 	"context"
 	"github.com/yylover/memcached-operator/k8sutil"
 	errors "k8s.io/apimachinery/pkg/api/errors"
+	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"time"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
 )
@@ -35,13 +43,26 @@ import (
 type RedisClusterReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Config 用于在pod中exec执行命令
+	Config *rest.Config
+	// Recorder 在CR上记录创建、扩缩容、故障切换和失败事件
+	Recorder record.EventRecorder
+	// ResyncPeriod 没有事件时定期重新调谐的周期, 0表示只由事件触发
+	ResyncPeriod time.Duration
 }
 
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redisclusters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redisclusters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redisclusters/finalizers,verbs=update
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisbackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;prometheusrules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=services;persistentvolumeclaims;pods;pods/exec,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete;deletecollection
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -52,102 +73,301 @@ type RedisClusterReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
-func (r *RedisClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *RedisClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	_ = ctrllog.FromContext(ctx)
 	log := ctrllog.FromContext(ctx)
 	log.Info("redis-cluster newcomming")
 
 	instance := &testopv1alpha1.RedisCluster{}
-	err := r.Client.Get(ctx, req.NamespacedName, instance)
+	err = r.Client.Get(ctx, req.NamespacedName, instance)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			log.Error(err, "RedisCluster instance get failed ")
 			return ctrl.Result{}, nil
 		}
+		log.Error(err, "get RedisCluster instance failed")
+		return ctrl.Result{}, err
+	}
+
+	if err := k8sutil.HandleRedisClusterFinalizer(ctx, instance, r.Client); err != nil {
+		log.Error(err, "HandleRedisClusterFinalizer failed")
+		return ctrl.Result{}, err
+	}
+	if instance.GetDeletionTimestamp() != nil {
+		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+	defer func() {
+		err = recordReconcileResult(ctx, r.Client, r.Recorder, instance, &instance.Status.Conditions, err)
+	}()
+	if err := k8sutil.AddRedisClusterFinalizer(ctx, instance, r.Client); err != nil {
+		return ctrl.Result{}, err
 	}
 
 	if err := controllerutil.SetControllerReference(instance, instance, r.Scheme); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	//创建leader
-	err = k8sutil.CreateRedisLeader(instance)
+	if err := k8sutil.ValidateRedisClusterPersistence(instance); err != nil {
+		return ctrl.Result{}, reconcileError("InvalidSpec", err)
+	}
+
+	restore, err := k8sutil.GetRedisRestoreBackup(ctx, instance.Namespace, instance.Name+"-leader", instance.Spec.RestoreFrom, r.Client)
 	if err != nil {
-		log.Error(err, "CreateRedisLeader failed")
+		log.Error(err, "get restore backup failed")
 		return ctrl.Result{}, err
 	}
-	if instance.Spec.RedisLeader.Replicas != nil && *instance.Spec.RedisLeader.Replicas != 0 {
-		err = k8sutil.CreateRedisLeaderService(instance)
+
+	phase, result, err := r.reconcileRedisClusterPhase(ctx, instance, restore)
+	if instance.Status.Phase != phase {
+		log.Info("redis cluster phase changed", "from", instance.Status.Phase, "to", phase)
+		instance.Status.Phase = phase
+		if updateErr := r.Status().Update(ctx, instance); updateErr != nil {
+			log.Error(updateErr, "update status failed")
+			if err == nil {
+				err = updateErr
+			}
+		}
+	}
+	return result, err
+}
+
+// reconcileRedisClusterPhase 按阶段推进集群, 每个阶段满足进入条件才会继续, 返回停留的阶段:
+// Provisioning创建资源, WaitingForPods等待所有pod就绪, Bootstrapping创建或恢复leader组成的集群,
+// Replicating把follower加入集群, Repairing故障切换、滚动升级或重新分配主从, 全部完成后为Ready
+func (r *RedisClusterReconciler) reconcileRedisClusterPhase(ctx context.Context, instance *testopv1alpha1.RedisCluster, restore *testopv1alpha1.RedisBackup) (string, ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	leaderReplicas := k8sutil.GetRedisLeaderReplicas(instance)
+	followerReplicas := k8sutil.GetRedisFollowerReplicas(instance)
+
+	if err := r.provisionRedisCluster(ctx, instance, restore, leaderReplicas, followerReplicas); err != nil {
+		return testopv1alpha1.RedisClusterPhaseProvisioning, ctrl.Result{}, err
+	}
+
+	//两个statefulSet的pod全部就绪后才操作集群
+	redisLeaderSet, err := k8sutil.GetStateFulSet(ctx, instance.Namespace, instance.ObjectMeta.Name+"-leader", r.Client)
+	if err != nil {
+		return testopv1alpha1.RedisClusterPhaseWaitingForPods, ctrl.Result{}, err
+	}
+	redisFollowerSet, err := k8sutil.GetStateFulSet(ctx, instance.Namespace, instance.ObjectMeta.Name+"-follower", r.Client)
+	if err != nil {
+		return testopv1alpha1.RedisClusterPhaseWaitingForPods, ctrl.Result{}, err
+	}
+	if redisLeaderSet.Status.ReadyReplicas != leaderReplicas || redisFollowerSet.Status.ReadyReplicas != followerReplicas {
+		log.Info("redis cluster pods are not ready", "leaderReady", redisLeaderSet.Status.ReadyReplicas, "leaderReplicas", leaderReplicas,
+			"followerReady", redisFollowerSet.Status.ReadyReplicas, "followerReplicas", followerReplicas)
+		return testopv1alpha1.RedisClusterPhaseWaitingForPods, resyncResult(r.ResyncPeriod), nil
+	}
+
+	nodeCount, err := k8sutil.CheckRedisNodeCount(ctx, instance, "", r.Client)
+	if err != nil {
+		return testopv1alpha1.RedisClusterPhaseBootstrapping, ctrl.Result{}, reconcileError("ClusterUnreachable", err)
+	}
+	if nodeCount != int(leaderReplicas+followerReplicas) {
+		leaderCount, err := k8sutil.CheckRedisNodeCount(ctx, instance, "leader", r.Client)
 		if err != nil {
-			log.Error(err, "CreateRedisLeaderService failed")
-			return ctrl.Result{}, nil
+			return testopv1alpha1.RedisClusterPhaseBootstrapping, ctrl.Result{}, reconcileError("ClusterUnreachable", err)
+		}
+		if leaderCount != int(leaderReplicas) {
+			log.Info("not all leader are part of the cluster ...", "leaders.Count", leaderCount, "leaderReplicas", leaderReplicas)
+			if restore != nil {
+				if err := k8sutil.ExecuteRedisClusterRestoreCommand(ctx, instance, restore, r.Client); err != nil {
+					return testopv1alpha1.RedisClusterPhaseBootstrapping, ctrl.Result{}, reconcileError("RestoreFailed", err)
+				}
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonCreated, "redis cluster restored from backup %s", restore.Name)
+			} else {
+				if err := k8sutil.ExecuteRedisClusterCommand(ctx, instance, r.Client, r.Config); err != nil {
+					return testopv1alpha1.RedisClusterPhaseBootstrapping, ctrl.Result{}, reconcileError("ClusterCreateFailed", err)
+				}
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonCreated, "redis cluster created with %d leaders", leaderReplicas)
+			}
+			//集群拓扑变化后尽快检查下一步
+			return testopv1alpha1.RedisClusterPhaseBootstrapping, ctrl.Result{RequeueAfter: time.Second * 10}, nil
+		}
+
+		if followerReplicas > 0 {
+			added, err := k8sutil.ExecuteRedisReplicationCommand(ctx, instance, r.Client, r.Config)
+			if added > 0 {
+				r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonScaled, "%d followers joined the redis cluster", added)
+			}
+			if err != nil {
+				return testopv1alpha1.RedisClusterPhaseReplicating, ctrl.Result{}, reconcileError("ReplicationFailed", err)
+			}
+		} else {
+			log.Info("no follower/replicas configured, skipping replication configuration", "leaderReplicas", leaderReplicas)
 		}
+		return testopv1alpha1.RedisClusterPhaseReplicating, ctrl.Result{RequeueAfter: time.Second * 10}, nil
 	}
 
-	//创建follower
-	err = k8sutil.CreateRedisFollower(instance)
+	log.Info("redis leader count is desired, check redis cluster status")
+	failed, err := k8sutil.CheckRedisClusterState(ctx, instance, r.Client)
+	if err != nil {
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("ClusterUnreachable", err)
+	}
+	if failed > 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonFailover, "%d redis cluster nodes failed, resetting the cluster nodes", failed)
+		if err := k8sutil.ExecuteFailoverOperation(ctx, instance, r.Client); err != nil {
+			return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("FailoverFailed", err)
+		}
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+
+	//CLUSTER FAILOVER完成前不做升级和迁移
+	pending, err := k8sutil.ReconcileRedisClusterFailover(ctx, instance, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisClusterFailover failed")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("FailoverFailed", err)
+	}
+	if pending {
+		log.Info("redis cluster failover in progress")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{RequeueAfter: time.Second * 5}, nil
+	}
+
+	upgrading, err := k8sutil.ReconcileRedisClusterUpgrade(ctx, instance, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisClusterUpgrade failed")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("UpgradeFailed", err)
+	}
+	if upgrading {
+		log.Info("redis cluster rolling upgrade in progress")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+
+	//先按可用区均衡master, 再调整副本的位置
+	moved, err := k8sutil.ReconcileRedisMasterZones(ctx, instance, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisMasterZones failed")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("RepairFailed", err)
+	}
+	if moved > 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRepaired, "failover started to move %d redis masters to balance the zones", moved)
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+
+	repaired, rule, err := k8sutil.ReconcileRedisReplicaPlacement(ctx, instance, r.Client)
+	if repaired > 0 {
+		r.Recorder.Eventf(instance, corev1.EventTypeNormal, eventReasonRepaired, "%d followers re-paired to satisfy the replica placement", repaired)
+	}
+	if err == nil {
+		err = recordReplicaPlacement(ctx, r.Client, r.Recorder, instance, rule)
+	}
+	if err != nil {
+		log.Error(err, "ReconcileRedisReplicaPlacement failed")
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{}, reconcileError("RepairFailed", err)
+	}
+	if repaired > 0 {
+		return testopv1alpha1.RedisClusterPhaseRepairing, ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+
+	backupWait, err := k8sutil.ReconcileRedisBackupSchedule(ctx, instance, "RedisCluster", instance.Spec.Backup, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisBackupSchedule failed")
+		return testopv1alpha1.RedisClusterPhaseReady, ctrl.Result{}, reconcileError("BackupScheduleFailed", err)
+	}
+
+	return testopv1alpha1.RedisClusterPhaseReady, resyncResult(r.ResyncPeriod, backupWait), nil
+}
+
+// provisionRedisCluster 创建或更新leader、follower的statefulSet和service, 以及对外访问、PDB、监控和配置
+func (r *RedisClusterReconciler) provisionRedisCluster(ctx context.Context, instance *testopv1alpha1.RedisCluster, restore *testopv1alpha1.RedisBackup, leaderReplicas, followerReplicas int32) error {
+	log := ctrllog.FromContext(ctx)
+	//检测镜像的redis版本, 7.x开启hostname、ACL文件和多文件AOF; 检测失败时沿用上次的版本
+	version := instance.Status.RedisVersion
+	if err := k8sutil.DetectRedisClusterVersion(ctx, instance, r.Client); err != nil {
+		log.Error(err, "DetectRedisClusterVersion failed")
+	}
+	if version != instance.Status.RedisVersion {
+		log.Info("redis version detected", "from", version, "to", instance.Status.RedisVersion)
+		if err := r.Status().Update(ctx, instance); err != nil {
+			log.Error(err, "update status failed")
+			return err
+		}
+	}
+
+	//创建leader
+	previousLeader, err := getPreviousStatefulSet(ctx, r.Client, instance.Namespace, instance.Name+"-leader")
+	if err != nil {
+		return err
+	}
+	err = k8sutil.CreateRedisLeader(ctx, instance, restore, r.Client)
 	if err != nil {
 		log.Error(err, "CreateRedisLeader failed")
-		return ctrl.Result{}, err
+		return statefulSetError(err)
 	}
-	if instance.Spec.RedisFollower.Replicas != nil && *instance.Spec.RedisFollower.Replicas != 0 {
-		err = k8sutil.CreateRedisFollowerService(instance)
+	recordStatefulSetChange(r.Recorder, instance, previousLeader, instance.Name+"-leader", leaderReplicas)
+	if leaderReplicas != 0 {
+		err = k8sutil.CreateRedisLeaderService(ctx, instance, r.Client)
 		if err != nil {
-			log.Error(err, "CreateRedisFollowerService failed")
-			return ctrl.Result{}, nil
+			log.Error(err, "CreateRedisLeaderService failed")
+			return reconcileError("ServiceFailed", err)
 		}
 	}
 
-	redisLeaderSet, err := k8sutil.GetStateFulSet(instance.Namespace, instance.ObjectMeta.Name+"-leader")
+	//创建follower
+	previousFollower, err := getPreviousStatefulSet(ctx, r.Client, instance.Namespace, instance.Name+"-follower")
 	if err != nil {
-		return ctrl.Result{}, err
+		return err
 	}
-	redisFollowerSet, err := k8sutil.GetStateFulSet(instance.Namespace, instance.ObjectMeta.Name+"-follower")
+	err = k8sutil.CreateRedisFollower(ctx, instance, r.Client)
 	if err != nil {
-		return ctrl.Result{}, err
+		log.Error(err, "CreateRedisFollower failed")
+		return statefulSetError(err)
 	}
-	leaderReplicas := instance.Spec.RedisLeader.Replicas
-	if leaderReplicas == nil {
-		leaderReplicas = instance.Spec.Size
+	recordStatefulSetChange(r.Recorder, instance, previousFollower, instance.Name+"-follower", followerReplicas)
+	if followerReplicas != 0 {
+		err = k8sutil.CreateRedisFollowerService(ctx, instance, r.Client)
+		if err != nil {
+			log.Error(err, "CreateRedisFollowerService failed")
+			return reconcileError("ServiceFailed", err)
+		}
 	}
-	followerReplicas := instance.Spec.RedisFollower.Replicas
-	if followerReplicas == nil {
-		followerReplicas = instance.Spec.Size
+
+	//对外访问: 每个pod的service和cluster-announce地址
+	if err := k8sutil.ReconcileRedisClusterExternalAccess(ctx, instance, r.Client); err != nil {
+		log.Error(err, "ReconcileRedisClusterExternalAccess failed")
+		return reconcileError("ExternalAccessFailed", err)
 	}
-	totalReplicas := *leaderReplicas + *followerReplicas
-	log.Info("replicas : ", "total:", totalReplicas, "leaderReplicas", *leaderReplicas, "followerReplicas:", *followerReplicas)
-	if int(redisLeaderSet.Status.ReadyReplicas) != int(*leaderReplicas) && int(redisFollowerSet.Status.ReadyReplicas) != int(*followerReplicas) {
-		log.Info("replicas size error:")
-		return ctrl.Result{RequeueAfter: time.Second * 30}, nil
+	//7.x通过headless service的域名互相访问
+	if err := k8sutil.ReconcileRedisClusterHostnames(ctx, instance, r.Client); err != nil {
+		log.Error(err, "ReconcileRedisClusterHostnames failed")
+		return reconcileError("HostnameFailed", err)
 	}
 
-	log.Info("create reader cluster by execting cluster creation commands")
-	if k8sutil.CheckRedisNodeCount(instance, "") != int(totalReplicas) {
-		leaderCount := k8sutil.CheckRedisNodeCount(instance, "leader")
-		log.Info("CheckRedisNodeCount lead : ", "leaderCount", leaderCount)
-		if leaderCount != int(*leaderReplicas) {
-			log.Info("not all leader are part of the cluster ...", "leaders.Count", leaderCount, "instance.Size", *leaderReplicas)
-			k8sutil.ExecuteRedisClusterCommand(instance)
-		} else {
-			if *followerReplicas > 0 {
-				k8sutil.ExecuteRedisReplicationCommand(instance)
-			} else {
-				log.Info("no follower/replicas configured, skipping replication configuration", "leaderCOunt:", *leaderReplicas, "followerCOunt:", *followerReplicas)
-			}
-		}
-	} else {
-		log.Info("redis leader count is desired, check redis cluster status")
-		if k8sutil.CheckRedisClusterState(instance) > 0 {
-			k8sutil.ExecuteFailoverOperation(instance)
+	for _, role := range []string{k8sutil.ClusterRoleLeader, k8sutil.ClusterRoleFollower} {
+		if err := k8sutil.ReconcileRedisPodDisruptionBudget(ctx, instance, role, r.Client); err != nil {
+			log.Error(err, "ReconcileRedisPodDisruptionBudget failed", "role", role)
+			return err
 		}
 	}
 
-	return ctrl.Result{RequeueAfter: time.Second * 20}, nil
+	if err := k8sutil.CreateRedisClusterMonitoring(ctx, instance, r.Client); err != nil {
+		log.Error(err, "CreateRedisClusterMonitoring failed")
+		return err
+	}
+
+	//配置变更: 能在线修改的参数执行CONFIG SET, 其余参数通过滚动更新生效
+	status := instance.Status.DeepCopy()
+	err = k8sutil.ReconcileRedisClusterConfig(ctx, instance, r.Client)
+	if !reflect.DeepEqual(status, &instance.Status) {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			log.Error(err, "update status failed")
+			return err
+		}
+	}
+	if err != nil {
+		log.Error(err, "ReconcileRedisClusterConfig failed")
+		return reconcileError("ConfigFailed", err)
+	}
+	return nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *RedisClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&testopv1alpha1.RedisCluster{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, enqueueRedisForPod("cluster"), builder.WithPredicates(redisPodPredicate())).
 		Complete(r)
 }
@@ -0,0 +1,159 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"github.com/yylover/memcached-operator/k8sutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
+
+	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+)
+
+// RedisReplicationReconciler reconciles a RedisReplication object
+type RedisReplicationReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Recorder 在CR上记录创建、扩缩容、主从切换和失败事件
+	Recorder record.EventRecorder
+	// ResyncPeriod 没有事件时定期重新调谐的周期, 0表示只由事件触发
+	ResyncPeriod time.Duration
+}
+
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisreplications,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisreplications/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisreplications/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=services;persistentvolumeclaims;pods;pods/exec,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+// It creates the StatefulSet and Services of the replication group, wires the
+// replicas to the current master and keeps the master Service pointed at it.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+func (r *RedisReplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	log := ctrllog.FromContext(ctx)
+	log.Info("redis-replication newcomming")
+
+	instance := &testopv1alpha1.RedisReplication{}
+	err = r.Client.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("redis-replication object cannot find")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "get redis-replication object failed")
+		return ctrl.Result{}, err
+	}
+	defer func() {
+		err = recordReconcileResult(ctx, r.Client, r.Recorder, instance, &instance.Status.Conditions, err)
+	}()
+
+	previous, err := getPreviousStatefulSet(ctx, r.Client, instance.Namespace, instance.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := k8sutil.CreateRedisReplication(ctx, instance, r.Client); err != nil {
+		return ctrl.Result{}, statefulSetError(err)
+	}
+	recordStatefulSetChange(r.Recorder, instance, previous, instance.Name, *instance.Spec.Size)
+	if err := k8sutil.CreateRedisReplicationService(ctx, instance, r.Client); err != nil {
+		return ctrl.Result{}, reconcileError("ServiceFailed", err)
+	}
+
+	//配置变更: 能在线修改的参数执行CONFIG SET, 其余参数通过滚动更新生效
+	configStatus := instance.Status.Config.DeepCopy()
+	err = k8sutil.ReconcileRedisReplicationConfig(ctx, instance, r.Client)
+	if !reflect.DeepEqual(configStatus, instance.Status.Config) {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+	if err != nil {
+		log.Error(err, "ReconcileRedisReplicationConfig failed")
+		return ctrl.Result{}, reconcileError("ConfigFailed", err)
+	}
+
+	redisSet, err := k8sutil.GetStateFulSet(ctx, instance.Namespace, instance.ObjectMeta.Name, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if redisSet.Status.ReadyReplicas == 0 {
+		log.Info("redis replication pods not ready", "ready", redisSet.Status.ReadyReplicas, "size", *instance.Spec.Size)
+		return resyncResult(r.ResyncPeriod), nil
+	}
+
+	//有sentinel监控时由sentinel负责故障切换
+	sentinels := &testopv1alpha1.RedisSentinelList{}
+	if err := r.List(ctx, sentinels, client.InNamespace(instance.Namespace)); err != nil {
+		log.Error(err, "list redis sentinel failed")
+		return ctrl.Result{}, err
+	}
+	allowPromotion := true
+	for _, sentinel := range sentinels.Items {
+		if sentinel.Spec.RedisSentinelConfig.RedisReplicationName == instance.Name {
+			allowPromotion = false
+			break
+		}
+	}
+
+	master, err := k8sutil.ReconcileRedisReplication(ctx, instance, allowPromotion, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisReplication failed")
+		return ctrl.Result{}, reconcileError("ReplicationFailed", err)
+	}
+	if master != "" && instance.Status.MasterNode != master {
+		if instance.Status.MasterNode != "" {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonFailover, "redis master switched from %s to %s", instance.Status.MasterNode, master)
+		}
+		instance.Status.MasterNode = master
+		if err := r.Status().Update(ctx, instance); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+
+	return resyncResult(r.ResyncPeriod), nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RedisReplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&testopv1alpha1.RedisReplication{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, enqueueRedisForPod("replication"), builder.WithPredicates(redisPodPredicate())).
+		Complete(r)
+}
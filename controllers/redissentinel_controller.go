@@ -0,0 +1,170 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"github.com/yylover/memcached-operator/k8sutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
+
+	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+)
+
+// RedisSentinelReconciler reconciles a RedisSentinel object
+type RedisSentinelReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Recorder 在CR上记录创建、扩缩容和master切换事件
+	Recorder record.EventRecorder
+	// ResyncPeriod 没有事件时定期重新调谐的周期, 0表示只由事件触发
+	ResyncPeriod time.Duration
+}
+
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redissentinels,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redissentinels/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redissentinels/finalizers,verbs=update
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisreplications,verbs=get;list;watch
+//+kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=services;pods,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+// It deploys the sentinels, registers the replication group with SENTINEL MONITOR
+// and follows the master Sentinel has promoted.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+func (r *RedisSentinelReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := ctrllog.FromContext(ctx)
+	log.Info("redis-sentinel newcomming")
+
+	instance := &testopv1alpha1.RedisSentinel{}
+	err := r.Client.Get(ctx, req.NamespacedName, instance)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("redis-sentinel object cannot find")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "get redis-sentinel object failed")
+		return ctrl.Result{}, err
+	}
+
+	previous, err := getPreviousStatefulSet(ctx, r.Client, instance.Namespace, instance.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := k8sutil.CreateRedisSentinel(ctx, instance, r.Client); err != nil {
+		r.Recorder.Event(instance, corev1.EventTypeWarning, eventReasonReconcileFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+	recordStatefulSetChange(r.Recorder, instance, previous, instance.Name, *instance.Spec.Size)
+	if err := k8sutil.CreateRedisSentinelService(ctx, instance, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	replication := &testopv1alpha1.RedisReplication{}
+	replicationName := types.NamespacedName{Namespace: instance.Namespace, Name: instance.Spec.RedisSentinelConfig.RedisReplicationName}
+	if err := r.Client.Get(ctx, replicationName, replication); err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("redis-replication of sentinel not found", "replication", replicationName.Name)
+			return resyncResult(r.ResyncPeriod), nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	sentinelSet, err := k8sutil.GetStateFulSet(ctx, instance.Namespace, instance.ObjectMeta.Name, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if sentinelSet.Status.ReadyReplicas == 0 {
+		log.Info("redis sentinel pods not ready", "ready", sentinelSet.Status.ReadyReplicas, "size", *instance.Spec.Size)
+		return resyncResult(r.ResyncPeriod), nil
+	}
+
+	masterPod, masterAddr, err := k8sutil.ReconcileRedisSentinel(ctx, instance, replication, r.Client)
+	if err != nil {
+		log.Error(err, "ReconcileRedisSentinel failed")
+		r.Recorder.Event(instance, corev1.EventTypeWarning, eventReasonReconcileFailed, err.Error())
+		return ctrl.Result{}, err
+	}
+	if instance.Status.MasterNode != masterPod || instance.Status.MasterAddress != masterAddr {
+		if instance.Status.MasterAddress != "" {
+			r.Recorder.Eventf(instance, corev1.EventTypeWarning, eventReasonFailover, "sentinel master switched from %s to %s", instance.Status.MasterAddress, masterAddr)
+		}
+		instance.Status.MasterNode = masterPod
+		instance.Status.MasterAddress = masterAddr
+		if err := r.Status().Update(ctx, instance); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+
+	//sentinel切换master时主从pod的就绪状态会变化, 由pod事件触发调谐
+	return resyncResult(r.ResyncPeriod), nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RedisSentinelReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&testopv1alpha1.RedisSentinel{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, enqueueRedisForPod("sentinel"), builder.WithPredicates(redisPodPredicate())).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, r.enqueueSentinelsForReplication("replication"), builder.WithPredicates(redisPodPredicate())).
+		Watches(&source.Kind{Type: &testopv1alpha1.RedisReplication{}}, r.enqueueSentinelsForReplication("")).
+		Complete(r)
+}
+
+// enqueueSentinelsForReplication 主从组或者它的pod变化时触发监控它的sentinel调谐; setupType为空时对象本身就是RedisReplication
+func (r *RedisSentinelReconciler) enqueueSentinelsForReplication(setupType string) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		name := obj.GetName()
+		if setupType != "" {
+			var ok bool
+			if name, ok = k8sutil.GetRedisInstanceName(obj.GetLabels(), setupType); !ok {
+				return nil
+			}
+		}
+		sentinels := &testopv1alpha1.RedisSentinelList{}
+		if err := r.List(context.Background(), sentinels, client.InNamespace(obj.GetNamespace())); err != nil {
+			return nil
+		}
+		var requests []reconcile.Request
+		for _, sentinel := range sentinels.Items {
+			if sentinel.Spec.RedisSentinelConfig.RedisReplicationName == name {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: sentinel.Namespace, Name: sentinel.Name}})
+			}
+		}
+		return requests
+	})
+}
@@ -19,11 +19,18 @@ package controllers
 import (
 	"context"
 	"github.com/yylover/memcached-operator/k8sutil"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"reflect"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 	"time"
 
 	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
@@ -33,13 +40,23 @@ import (
 type RedisSingleReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// Recorder 在CR上记录创建、扩缩容和失败事件
+	Recorder record.EventRecorder
+	// ResyncPeriod 没有事件时定期重新调谐的周期, 0表示只由事件触发
+	ResyncPeriod time.Duration
 }
 
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redissingles,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redissingles/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=testop.yylover.com,resources=redissingles/finalizers,verbs=update
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisbackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;prometheusrules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=services;persistentvolumeclaims;pods;pods/exec,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;delete;deletecollection
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -50,12 +67,12 @@ type RedisSingleReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
-func (r *RedisSingleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *RedisSingleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	log := ctrllog.FromContext(ctx)
 	log.Info("redis-single newcomming")
 	// your logic here
 	redis := &testopv1alpha1.RedisSingle{}
-	err := r.Client.Get(ctx, req.NamespacedName, redis)
+	err = r.Client.Get(ctx, req.NamespacedName, redis)
 	if err != nil {
 		if errors.IsNotFound(err) {
 			log.Info("redis-single object cannot find")
@@ -66,11 +83,17 @@ func (r *RedisSingleReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	//判断资源是否删除，删除的话要清掉相关的finalizer?
 	//handle finalizer
-	if err := k8sutil.HandleRedisFinalizer(redis, r.Client); err != nil {
+	if err := k8sutil.HandleRedisFinalizer(ctx, redis, r.Client); err != nil {
 		return ctrl.Result{}, err
 	}
+	if redis.GetDeletionTimestamp() != nil {
+		return ctrl.Result{RequeueAfter: time.Second * 10}, nil
+	}
+	defer func() {
+		err = recordReconcileResult(ctx, r.Client, r.Recorder, redis, &redis.Status.Conditions, err)
+	}()
 
-	if err := k8sutil.AddRedisFinalizer(redis, r.Client); err != nil {
+	if err := k8sutil.AddRedisFinalizer(ctx, redis, r.Client); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -79,24 +102,88 @@ func (r *RedisSingleReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, err
 	}
 
+	if err := k8sutil.ValidateRedisSinglePersistence(redis); err != nil {
+		return ctrl.Result{}, reconcileError("InvalidSpec", err)
+	}
+
+	//从备份恢复
+	restore, err := k8sutil.GetRedisRestoreBackup(ctx, redis.Namespace, redis.Name, redis.Spec.RestoreFrom, r.Client)
+	if err != nil {
+		log.Error(err, "get restore backup failed")
+		return ctrl.Result{}, err
+	}
+
+	//检测镜像的redis版本, 7.x开启ACL文件和多文件AOF; 检测失败时沿用上次的版本
+	version := redis.Status.RedisVersion
+	if err := k8sutil.DetectRedisSingleVersion(ctx, redis, r.Client); err != nil {
+		log.Error(err, "detect redis version failed")
+	}
+	if version != redis.Status.RedisVersion {
+		log.Info("redis version detected", "from", version, "to", redis.Status.RedisVersion)
+		if err := r.Status().Update(ctx, redis); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+
 	//创建statefulSet
-	err = k8sutil.CreateSingleRedis(redis)
+	previous, err := getPreviousStatefulSet(ctx, r.Client, redis.Namespace, redis.Name)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	err = k8sutil.CreateSingleRedis(ctx, redis, restore, r.Client)
+	if err != nil {
+		return ctrl.Result{}, statefulSetError(err)
+	}
+	recordStatefulSetChange(r.Recorder, redis, previous, redis.Name, 1)
+
+	//配置变更: 能在线修改的参数执行CONFIG SET, 其余参数通过滚动更新生效
+	configStatus := redis.Status.Config.DeepCopy()
+	err = k8sutil.ReconcileRedisSingleConfig(ctx, redis, r.Client)
+	if !reflect.DeepEqual(configStatus, redis.Status.Config) {
+		if err := r.Status().Update(ctx, redis); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+	if err != nil {
+		return ctrl.Result{}, reconcileError("ConfigFailed", err)
+	}
 
 	//创建headless service
-	err = k8sutil.CreateSingleRedisService(redis)
+	err = k8sutil.CreateSingleRedisService(ctx, redis, r.Client)
+	if err != nil {
+		return ctrl.Result{}, reconcileError("ServiceFailed", err)
+	}
+
+	err = k8sutil.ReconcileRedisSinglePodDisruptionBudget(ctx, redis, r.Client)
 	if err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{RequeueAfter: time.Second * 15}, nil
+	//ServiceMonitor和PrometheusRule
+	err = k8sutil.CreateRedisSingleMonitoring(ctx, redis, r.Client)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	//定时备份
+	backupWait, err := k8sutil.ReconcileRedisBackupSchedule(ctx, redis, "RedisSingle", redis.Spec.Backup, r.Client)
+	if err != nil {
+		return ctrl.Result{}, reconcileError("BackupScheduleFailed", err)
+	}
+
+	return resyncResult(r.ResyncPeriod, backupWait), nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *RedisSingleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&testopv1alpha1.RedisSingle{}).
+		Owns(&appsv1.StatefulSet{}).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&policyv1.PodDisruptionBudget{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, enqueueRedisForPod("standalone"), builder.WithPredicates(redisPodPredicate())).
 		Complete(r)
 }
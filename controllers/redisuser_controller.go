@@ -0,0 +1,134 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"github.com/yylover/memcached-operator/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"reflect"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	ctrllog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"time"
+
+	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+)
+
+// RedisUserReconciler reconciles a RedisUser object
+type RedisUserReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// Recorder 在CR上记录失败事件
+	Recorder record.EventRecorder
+	// ResyncPeriod 定期重新设置用户, 修改secret中的密码后最迟在一个周期内生效
+	ResyncPeriod time.Duration
+}
+
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisusers,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisusers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=testop.yylover.com,resources=redisusers/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+// The user is applied with ACL SETUSER on every ready node of the referenced
+// RedisSingle or RedisCluster and removed with ACL DELUSER when the CR is deleted.
+//
+// For more details, check Reconcile and its Result here:
+// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.10.0/pkg/reconcile
+func (r *RedisUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	log := ctrllog.FromContext(ctx)
+	log.Info("redis-user newcomming")
+
+	user := &testopv1alpha1.RedisUser{}
+	err = r.Client.Get(ctx, req.NamespacedName, user)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			log.Info("redis-user object cannot find")
+			return ctrl.Result{}, nil
+		}
+		log.Error(err, "get redis-user object failed")
+		return ctrl.Result{}, err
+	}
+
+	if user.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, k8sutil.HandleRedisUserFinalizer(ctx, user, r.Client)
+	}
+	defer func() {
+		err = recordReconcileResult(ctx, r.Client, r.Recorder, user, &user.Status.Conditions, err)
+	}()
+
+	if err := k8sutil.AddRedisUserFinalizer(ctx, user, r.Client); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := k8sutil.ValidateRedisUser(user); err != nil {
+		return ctrl.Result{}, reconcileError("InvalidSpec", err)
+	}
+
+	nodes, err := k8sutil.ReconcileRedisUser(ctx, user, r.Client)
+	if !reflect.DeepEqual(nodes, user.Status.Nodes) {
+		user.Status.Nodes = nodes
+		if err := r.Status().Update(ctx, user); err != nil {
+			log.Error(err, "update status failed")
+			return ctrl.Result{}, err
+		}
+	}
+	if err != nil {
+		return ctrl.Result{}, reconcileError("ACLFailed", err)
+	}
+
+	return resyncResult(r.ResyncPeriod), nil
+}
+
+// enqueueRedisUsersForPod redis pod重建或就绪后重新设置引用该实例的用户
+func (r *RedisUserReconciler) enqueueRedisUsersForPod() handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		users := &testopv1alpha1.RedisUserList{}
+		if err := r.Client.List(context.Background(), users, client.InNamespace(obj.GetNamespace())); err != nil {
+			return nil
+		}
+		var requests []reconcile.Request
+		for i := range users.Items {
+			user := &users.Items[i]
+			name, ok := k8sutil.GetRedisInstanceName(obj.GetLabels(), k8sutil.GetRedisUserSetupType(user))
+			if ok && name == user.Spec.Redis.Name {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: user.Namespace, Name: user.Name}})
+			}
+		}
+		return requests
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RedisUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&testopv1alpha1.RedisUser{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, r.enqueueRedisUsersForPod(), builder.WithPredicates(redisPodPredicate())).
+		Complete(r)
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/yylover/memcached-operator/k8sutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// enqueueRedisForPod 按pod的标签找到所属的CR并触发调谐
+func enqueueRedisForPod(setupType string) handler.EventHandler {
+	return handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+		name, ok := k8sutil.GetRedisInstanceName(obj.GetLabels(), setupType)
+		if !ok {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+	})
+}
+
+// redisPodPredicate 只关心pod的创建、删除以及ip、就绪状态的变化, 忽略其他状态更新
+func redisPodPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPod, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			newPod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return false
+			}
+			return oldPod.Status.PodIP != newPod.Status.PodIP ||
+				k8sutil.IsPodReady(oldPod) != k8sutil.IsPodReady(newPod) ||
+				(oldPod.DeletionTimestamp == nil) != (newPod.DeletionTimestamp == nil)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
+
+// resyncResult 调谐由事件驱动, resync只作为兜底; 有更早需要触发的时间(比如下次定时备份)时取较小值
+func resyncResult(resync time.Duration, waits ...time.Duration) ctrl.Result {
+	requeue := resync
+	for _, wait := range waits {
+		if wait > 0 && (requeue <= 0 || wait < requeue) {
+			requeue = wait
+		}
+	}
+	return ctrl.Result{RequeueAfter: requeue}
+}
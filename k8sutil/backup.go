@@ -0,0 +1,358 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/robfig/cron/v3"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// BackupSourceLabel/BackupKindLabel 标记定时任务创建的备份, 用于查找和清理
+	BackupSourceLabel = "redis_backup_source"
+	BackupKindLabel   = "redis_backup_kind"
+
+	// BackupTimeout 备份需要在该时间内完成
+	BackupTimeout = 10 * time.Minute
+)
+
+// redisBackupTarget 需要备份的一个redis节点
+type redisBackupTarget struct {
+	PodName   string
+	IP        string
+	Container string
+	Slots     []string
+}
+
+// getRedisBackupTargets 获取需要备份的master节点, 集群模式按CLUSTER NODES中的实际角色
+func getRedisBackupTargets(ctx context.Context, backup *v1alpha1.RedisBackup, cl client.Client) ([]redisBackupTarget, error) {
+	key := types.NamespacedName{Namespace: backup.Namespace, Name: backup.Spec.Source.Name}
+	switch backup.Spec.Source.Kind {
+	case "RedisSingle":
+		single := &v1alpha1.RedisSingle{}
+		if err := cl.Get(ctx, key, single); err != nil {
+			return nil, err
+		}
+		pod := &corev1.Pod{}
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: single.Namespace, Name: single.Name + "-0"}, pod); err != nil {
+			return nil, err
+		}
+		if pod.Status.PodIP == "" {
+			return nil, fmt.Errorf("redis pod %s is not ready", pod.Name)
+		}
+		return []redisBackupTarget{{PodName: pod.Name, IP: pod.Status.PodIP, Container: single.Name}}, nil
+	case "RedisCluster":
+		cluster := &v1alpha1.RedisCluster{}
+		if err := cl.Get(ctx, key, cluster); err != nil {
+			return nil, err
+		}
+		nodes, err := checkRedisCluster(ctx, cluster, cl)
+		if err != nil {
+			return nil, err
+		}
+		var targets []redisBackupTarget
+		for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+			pods, err := getRedisPodPlacements(ctx, cluster, role, cl)
+			if err != nil {
+				return nil, err
+			}
+			for _, pod := range pods {
+				node := getRedisNodeByIP(nodes, pod.IP)
+				if len(node) < 8 || !strings.Contains(node[2], "master") || strings.Contains(node[2], "fail") {
+					continue
+				}
+				targets = append(targets, redisBackupTarget{
+					PodName:   pod.PodName,
+					IP:        pod.IP,
+					Container: cluster.Name + "-" + role,
+					Slots:     node[8:],
+				})
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no redis master found in cluster %s", cluster.Name)
+		}
+		return targets, nil
+	}
+	return nil, fmt.Errorf("unsupported backup source kind %q", backup.Spec.Source.Kind)
+}
+
+// generateBackupObjectKey 生成备份文件在bucket中的路径: <prefix>/<kind>/<source>/<backup>/<pod>.rdb
+func generateBackupObjectKey(backup *v1alpha1.RedisBackup, podName string) string {
+	return strings.TrimPrefix(path.Join(backup.Spec.Storage.Prefix, strings.ToLower(backup.Spec.Source.Kind),
+		backup.Spec.Source.Name, backup.Name, podName+".rdb"), "/")
+}
+
+// ReconcileRedisBackup 对每个master执行BGSAVE并记录到status, BGSAVE完成后上传rdb文件;
+// 不等待BGSAVE完成, 返回是否所有master都已上传, 超过status中的deadline时返回错误
+func ReconcileRedisBackup(ctx context.Context, backup *v1alpha1.RedisBackup, cl client.Client, config *rest.Config) (bool, error) {
+	logger := generateRedisManagerLogger(backup.Namespace, backup.Name)
+	if backup.Status.Deadline != nil && time.Now().After(backup.Status.Deadline.Time) {
+		return false, fmt.Errorf("redis backup not finished in %s", BackupTimeout)
+	}
+	targets, err := getRedisBackupTargets(ctx, backup, cl)
+	if err != nil {
+		logger.Error(err, "get redis backup targets failed")
+		return false, err
+	}
+	s3, err := newS3Client(ctx, backup.Namespace, backup.Spec.Storage, cl)
+	if err != nil {
+		logger.Error(err, "create backup storage client failed")
+		return false, err
+	}
+
+	done := true
+	for _, target := range targets {
+		if getRedisBackupRecord(backup, target.PodName) != nil {
+			continue
+		}
+		rdbPath, err := reconcileRedisBackgroundSave(backup, target)
+		if err != nil {
+			logger.Error(err, "redis bgsave failed", "pod", target.PodName)
+			return false, err
+		}
+		if rdbPath == "" {
+			done = false
+			continue
+		}
+		size, err := getRedisRDBSize(backup.Namespace, target, rdbPath, config)
+		if err != nil {
+			logger.Error(err, "get redis rdb size failed", "pod", target.PodName)
+			return false, err
+		}
+		key := generateBackupObjectKey(backup, target.PodName)
+		logger.Info("upload redis rdb", "pod", target.PodName, "key", key)
+		if err := uploadRedisRDB(ctx, backup.Namespace, target, rdbPath, s3, key, size, config); err != nil {
+			logger.Error(err, "upload redis rdb failed", "pod", target.PodName, "key", key)
+			return false, err
+		}
+		backup.Status.Records = append(backup.Status.Records, v1alpha1.BackupRecord{
+			PodName: target.PodName,
+			Key:     key,
+			Size:    size,
+			Slots:   target.Slots,
+		})
+	}
+	return done, nil
+}
+
+// getRedisBackupRecord 获取pod已上传的备份记录
+func getRedisBackupRecord(backup *v1alpha1.RedisBackup, podName string) *v1alpha1.BackupRecord {
+	for i := range backup.Status.Records {
+		if backup.Status.Records[i].PodName == podName {
+			return &backup.Status.Records[i]
+		}
+	}
+	return nil
+}
+
+// reconcileRedisBackgroundSave 没有执行过BGSAVE时执行并记录到status, 已执行时检查INFO persistence,
+// 完成后返回rdb文件路径, 未完成时返回空
+func reconcileRedisBackgroundSave(backup *v1alpha1.RedisBackup, target redisBackupTarget) (string, error) {
+	redisClient := newRedisClient(generateRedisAddr(target.IP, redisPort))
+	defer redisClient.Close()
+
+	info, err := getRedisInfo(redisClient, "persistence")
+	if err != nil {
+		return "", err
+	}
+	var save *v1alpha1.BackupSave
+	for i := range backup.Status.Saves {
+		if backup.Status.Saves[i].PodName == target.PodName {
+			save = &backup.Status.Saves[i]
+		}
+	}
+	//其他BGSAVE还在进行时等待它结束
+	if info["rdb_bgsave_in_progress"] != "0" {
+		return "", nil
+	}
+	if save == nil {
+		if err := redisClient.BgSave().Err(); err != nil {
+			return "", err
+		}
+		backup.Status.Saves = append(backup.Status.Saves, v1alpha1.BackupSave{
+			PodName:      target.PodName,
+			LastSaveTime: info["rdb_last_save_time"],
+		})
+		return "", nil
+	}
+	if info["rdb_last_bgsave_status"] != "ok" {
+		return "", fmt.Errorf("redis bgsave status is %q", info["rdb_last_bgsave_status"])
+	}
+	//AOF重写期间BGSAVE会延后执行, rdb_last_save_time变化后才是本次保存的文件
+	if info["rdb_last_save_time"] == save.LastSaveTime {
+		return "", nil
+	}
+
+	dir, err := getRedisConfig(redisClient, "dir")
+	if err != nil {
+		return "", err
+	}
+	dbfilename, err := getRedisConfig(redisClient, "dbfilename")
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, dbfilename), nil
+}
+
+// getRedisConfig 执行CONFIG GET获取单个配置
+func getRedisConfig(redisClient *redis.Client, name string) (string, error) {
+	values, err := redisClient.ConfigGet(name).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(values) < 2 {
+		return "", fmt.Errorf("redis config %s not found", name)
+	}
+	return fmt.Sprint(values[1]), nil
+}
+
+// getRedisRDBSize 获取pod中rdb文件大小, 上传时需要Content-Length
+func getRedisRDBSize(namespace string, target redisBackupTarget, rdbPath string, config *rest.Config) (int64, error) {
+	var out strings.Builder
+	stderr, err := execPodCommand(namespace, target.PodName, target.Container, []string{"stat", "-c", "%s", rdbPath}, &out, config)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, stderr)
+	}
+	return strconv.ParseInt(strings.TrimSpace(out.String()), 10, 64)
+}
+
+// uploadRedisRDB 通过exec读取rdb文件并流式上传到对象存储
+func uploadRedisRDB(ctx context.Context, namespace string, target redisBackupTarget, rdbPath string, s3 *s3Client, key string, size int64, config *rest.Config) error {
+	reader, writer := io.Pipe()
+	go func() {
+		stderr, err := execPodCommand(namespace, target.PodName, target.Container, []string{"cat", rdbPath}, writer, config)
+		if err != nil {
+			err = fmt.Errorf("%v: %s", err, stderr)
+		}
+		writer.CloseWithError(err)
+	}()
+	err := s3.putObject(ctx, key, reader, size)
+	reader.Close()
+	return err
+}
+
+// DeleteRedisBackupObjects 删除备份在对象存储中的文件
+func DeleteRedisBackupObjects(ctx context.Context, backup *v1alpha1.RedisBackup, cl client.Client) error {
+	logger := generateRedisManagerLogger(backup.Namespace, backup.Name)
+	if len(backup.Status.Records) == 0 {
+		return nil
+	}
+	s3, err := newS3Client(ctx, backup.Namespace, backup.Spec.Storage, cl)
+	if err != nil {
+		logger.Error(err, "create backup storage client failed")
+		return err
+	}
+	for _, record := range backup.Status.Records {
+		logger.Info("delete redis backup object", "key", record.Key)
+		if err := s3.deleteObject(ctx, record.Key); err != nil {
+			logger.Error(err, "delete redis backup object failed", "key", record.Key)
+			return err
+		}
+	}
+	return nil
+}
+
+// ReconcileRedisBackupSchedule 按cron表达式为redis创建RedisBackup, 并按keepLast清理旧的备份, 返回距离下次备份的时间
+func ReconcileRedisBackupSchedule(ctx context.Context, source metav1.Object, kind string, schedule *v1alpha1.BackupSchedule, cl client.Client) (time.Duration, error) {
+	if schedule == nil {
+		return 0, nil
+	}
+	logger := generateRedisManagerLogger(source.GetNamespace(), source.GetName())
+	sched, err := cron.ParseStandard(schedule.Schedule)
+	if err != nil {
+		logger.Error(err, "invalid backup schedule", "schedule", schedule.Schedule)
+		return 0, err
+	}
+
+	backupLabels := map[string]string{
+		BackupSourceLabel: source.GetName(),
+		BackupKindLabel:   strings.ToLower(kind),
+	}
+	backups := &v1alpha1.RedisBackupList{}
+	if err := cl.List(ctx, backups, client.InNamespace(source.GetNamespace()), client.MatchingLabels(backupLabels)); err != nil {
+		logger.Error(err, "list redis backups failed")
+		return 0, err
+	}
+	sort.Slice(backups.Items, func(i, j int) bool {
+		return backups.Items[j].CreationTimestamp.Before(&backups.Items[i].CreationTimestamp)
+	})
+
+	last := source.GetCreationTimestamp().Time
+	running := false
+	for _, backup := range backups.Items {
+		if backup.CreationTimestamp.After(last) {
+			last = backup.CreationTimestamp.Time
+		}
+		if backup.Status.Phase == "" || backup.Status.Phase == v1alpha1.BackupPhaseRunning {
+			running = true
+		}
+	}
+
+	now := time.Now()
+	if !running && !now.Before(sched.Next(last)) {
+		backup := &v1alpha1.RedisBackup{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      source.GetName() + "-" + strconv.FormatInt(now.Unix(), 10),
+				Namespace: source.GetNamespace(),
+				Labels:    backupLabels,
+			},
+			Spec: v1alpha1.RedisBackupSpec{
+				Source:  v1alpha1.BackupSource{Kind: kind, Name: source.GetName()},
+				Storage: schedule.Storage,
+			},
+		}
+		logger.Info("create scheduled redis backup", "backup", backup.Name)
+		if err := cl.Create(ctx, backup); err != nil && !errors.IsAlreadyExists(err) {
+			logger.Error(err, "create redis backup failed", "backup", backup.Name)
+			return 0, err
+		}
+		last = now
+	}
+	next := time.Until(sched.Next(last))
+
+	if schedule.KeepLast == nil {
+		return next, nil
+	}
+	kept := 0
+	for i := range backups.Items {
+		backup := &backups.Items[i]
+		// 只有成功的备份计入保留个数, 失败的备份在有足够新的成功备份后清理
+		switch backup.Status.Phase {
+		case v1alpha1.BackupPhaseCompleted:
+			if kept < int(*schedule.KeepLast) {
+				kept++
+				continue
+			}
+		case v1alpha1.BackupPhaseFailed:
+			if kept < int(*schedule.KeepLast) {
+				continue
+			}
+		default:
+			continue
+		}
+		if backup.GetDeletionTimestamp() != nil {
+			continue
+		}
+		logger.Info("delete expired redis backup", "backup", backup.Name)
+		if err := cl.Delete(ctx, backup); err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "delete redis backup failed", "backup", backup.Name)
+			return 0, err
+		}
+	}
+	return next, nil
+}
@@ -1,29 +0,0 @@
-package k8sutil
-
-import (
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
-)
-
-//generateK8sClient 创建kubenetest client
-func generateK8sClient() *kubernetes.Clientset {
-	config, err := generateK8sConfig()
-	if err != nil {
-		panic(err)
-	}
-
-	client, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		panic(err)
-	}
-	return client
-}
-
-// generateK8sConfig 加载kube config 文件
-func generateK8sConfig() (*rest.Config, error) {
-	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
-	configOverrides := &clientcmd.ConfigOverrides{}
-	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, configOverrides)
-	return kubeconfig.ClientConfig()
-}
@@ -0,0 +1,81 @@
+package k8sutil
+
+import (
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+)
+
+const (
+	redisWritableConfigPath       = "/etc/redis/conf"
+	redisWritableConfigFile       = redisWritableConfigPath + "/redis.conf"
+	redisWritableConfigVolumeName = "redis-config"
+)
+
+// redisEngine 兼容redis协议的服务端实现
+type redisEngine struct {
+	// Image 默认镜像
+	Image string
+	// Server 服务端程序, 为空时使用镜像自带的启动脚本
+	Server string
+	// CLI 集群管理使用的命令行工具
+	CLI string
+}
+
+var redisEngines = map[string]redisEngine{
+	v1alpha1.RedisEngineRedis:  {Image: "quay.io/opstree/redis:v6.2.5", CLI: "redis-cli"},
+	v1alpha1.RedisEngineValkey: {Image: "valkey/valkey:7.2.5", Server: "valkey-server", CLI: "valkey-cli"},
+	v1alpha1.RedisEngineKeyDB:  {Image: "eqalpha/keydb:x86_64_v6.3.4", Server: "keydb-server", CLI: "keydb-cli"},
+}
+
+// getRedisEngine 获取engine的默认配置, 未设置或未知时使用redis
+func getRedisEngine(engine string) redisEngine {
+	if res, ok := redisEngines[engine]; ok {
+		return res
+	}
+	return redisEngines[v1alpha1.RedisEngineRedis]
+}
+
+// getRedisEngineImage 用户没有指定镜像时使用engine的默认镜像
+func getRedisEngineImage(engine, image string) string {
+	if image != "" {
+		return image
+	}
+	return getRedisEngine(engine).Image
+}
+
+// generateRedisEngineCommand 官方的valkey、keydb镜像没有opstree的启动脚本, 直接用生成的配置启动服务端;
+// configMap挂载只读, 使用init container复制到emptyDir的配置, CONFIG REWRITE才能写回
+func generateRedisEngineCommand(engine string) []string {
+	server := getRedisEngine(engine).Server
+	if server == "" {
+		return nil
+	}
+	return []string{server, redisWritableConfigFile}
+}
+
+// useRedisWritableConfig 直接用生成的配置启动的engine需要可写的配置文件
+func useRedisWritableConfig(engine string) bool {
+	return getRedisEngine(engine).Server != ""
+}
+
+// generateRedisEngineConfig opstree启动脚本写入redis.conf的基础配置, 其他engine由operator渲染到生成的配置中;
+// keydb默认开启多线程, 和redis的行为保持一致只使用一个工作线程
+func generateRedisEngineConfig(engine string, cluster bool) map[string]string {
+	res := map[string]string{}
+	if getRedisEngine(engine).Server == "" {
+		return res
+	}
+	res["bind"] = "0.0.0.0"
+	res["protected-mode"] = "no"
+	res["dir"] = redisDataPath
+	if cluster {
+		res["cluster-enabled"] = "yes"
+		res["cluster-config-file"] = redisDataPath + "/nodes.conf"
+		res["cluster-node-timeout"] = "5000"
+		res["cluster-require-full-coverage"] = "no"
+		res["cluster-migration-barrier"] = "1"
+	}
+	if engine == v1alpha1.RedisEngineKeyDB {
+		res["server-threads"] = "1"
+	}
+	return res
+}
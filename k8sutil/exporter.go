@@ -0,0 +1,272 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultRedisExporterImage = "oliver006/redis_exporter:v1.33.0"
+	defaultRedisExporterPort  = 9121
+	defaultScrapeInterval     = "30s"
+	redisExporterPortName     = "redis-exporter"
+	// RedisMetricsLabel 标记exporter的service, ServiceMonitor通过它选择service
+	RedisMetricsLabel = "redis_metrics"
+)
+
+var (
+	serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+	prometheusRuleGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PrometheusRule"}
+)
+
+// getRedisExporterPort 获取exporter端口
+func getRedisExporterPort(port *int32) int32 {
+	if port != nil {
+		return *port
+	}
+	return defaultRedisExporterPort
+}
+
+// setRedisExporterParams 把exporter配置写入容器参数
+func setRedisExporterParams(exporter *v1alpha1.RedisExporter, params *containerParameters) {
+	params.RedisExporterImage = exporter.Image
+	if params.RedisExporterImage == "" {
+		params.RedisExporterImage = defaultRedisExporterImage
+	}
+	params.RedisExporterImagePullPolicy = exporter.ImagePullPolicy
+	params.RedisExporterResources = exporter.Resources
+	params.RedisExporterPort = exporter.Port
+}
+
+// generateRedisExporterContainer 生成exporter sidecar
+func generateRedisExporterContainer(params containerParameters) corev1.Container {
+	port := getRedisExporterPort(params.RedisExporterPort)
+	container := corev1.Container{
+		Name:            redisExporterPortName,
+		Image:           params.RedisExporterImage,
+		ImagePullPolicy: params.RedisExporterImagePullPolicy,
+		Env: []corev1.EnvVar{
+			{Name: "REDIS_ADDR", Value: "redis://localhost:" + strconv.Itoa(redisPort)},
+			{Name: "REDIS_EXPORTER_WEB_LISTEN_ADDRESS", Value: ":" + strconv.Itoa(int(port))},
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          redisExporterPortName,
+				ContainerPort: port,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
+	}
+	if params.RedisExporterResources != nil {
+		container.Resources = *params.RedisExporterResources
+	}
+	return container
+}
+
+// CreateOrUpdateRedisMetricsService exporter开启时创建<name>-metrics service, 关闭时删除
+func CreateOrUpdateRedisMetricsService(ctx context.Context, namespace string, serviceMeta metav1.ObjectMeta, ownerRef metav1.OwnerReference, exporter *v1alpha1.RedisExporter, cl client.Client) error {
+	if exporter == nil {
+		return deleteService(ctx, namespace, serviceMeta.Name, cl)
+	}
+	selector := serviceMeta.Labels
+	labels := map[string]string{RedisMetricsLabel: "true"}
+	for k, v := range selector {
+		labels[k] = v
+	}
+	serviceMeta.Labels = labels
+
+	port := int(getRedisExporterPort(exporter.Port))
+	service := generateServiceDef(serviceMeta, selector, ownerRef, port)
+	service.Spec.Ports = []corev1.ServicePort{
+		{
+			Name:       redisExporterPortName,
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(port),
+			Protocol:   corev1.ProtocolTCP,
+		},
+	}
+	return createOrUpdateService(ctx, namespace, service, cl)
+}
+
+// deleteService 删除service, 不存在时忽略
+func deleteService(ctx context.Context, namespace string, serviceName string, cl client.Client) error {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: serviceName}}
+	err := cl.Delete(ctx, service)
+	if err != nil && !errors.IsNotFound(err) {
+		serviceLogger(namespace, serviceName).Error(err, "Redis service delete failed")
+		return err
+	}
+	return nil
+}
+
+// CreateRedisSingleMonitoring 创建或删除单例的ServiceMonitor和PrometheusRule
+func CreateRedisSingleMonitoring(ctx context.Context, cr *v1alpha1.RedisSingle, cl client.Client) error {
+	return reconcileRedisMonitoring(ctx, cr.ObjectMeta, redisAsOwner(cr), cr.Spec.RedisExporter, []string{cr.Name}, false, cl)
+}
+
+// CreateRedisClusterMonitoring 创建或删除集群的ServiceMonitor和PrometheusRule, 同时采集leader和follower
+func CreateRedisClusterMonitoring(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	apps := []string{cr.Name + "-" + ClusterRoleLeader, cr.Name + "-" + ClusterRoleFollower}
+	return reconcileRedisMonitoring(ctx, cr.ObjectMeta, redisClusterAsOwner(cr), cr.Spec.RedisExporter, apps, true, cl)
+}
+
+// reconcileRedisMonitoring ServiceMonitor和PrometheusRule没有go类型, 使用unstructured对象管理
+func reconcileRedisMonitoring(ctx context.Context, meta metav1.ObjectMeta, ownerRef metav1.OwnerReference, exporter *v1alpha1.RedisExporter, apps []string, cluster bool, cl client.Client) error {
+	if exporter == nil || exporter.ServiceMonitor == nil {
+		if err := deleteUnstructured(ctx, meta.Namespace, meta.Name, serviceMonitorGVK, cl); err != nil {
+			return err
+		}
+	} else {
+		serviceMonitor := generateServiceMonitor(meta, ownerRef, exporter.ServiceMonitor, apps)
+		if err := createOrUpdateUnstructured(ctx, serviceMonitor, cl); err != nil {
+			return err
+		}
+	}
+
+	if exporter == nil || exporter.PrometheusRule == nil {
+		return deleteUnstructured(ctx, meta.Namespace, meta.Name, prometheusRuleGVK, cl)
+	}
+	return createOrUpdateUnstructured(ctx, generatePrometheusRule(meta, ownerRef, exporter.PrometheusRule, apps, cluster), cl)
+}
+
+// generateServiceMonitor 生成ServiceMonitor, 选择exporter的metrics service
+func generateServiceMonitor(meta metav1.ObjectMeta, ownerRef metav1.OwnerReference, config *v1alpha1.ServiceMonitorConfig, apps []string) *unstructured.Unstructured {
+	interval := config.Interval
+	if interval == "" {
+		interval = defaultScrapeInterval
+	}
+	values := make([]interface{}, 0, len(apps))
+	for _, app := range apps {
+		values = append(values, app)
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{RedisMetricsLabel: "true"},
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "app", "operator": "In", "values": values},
+				},
+			},
+			"namespaceSelector": map[string]interface{}{
+				"matchNames": []interface{}{meta.Namespace},
+			},
+			"endpoints": []interface{}{
+				map[string]interface{}{"port": redisExporterPortName, "interval": interval},
+			},
+		},
+	}}
+	setMonitoringMeta(obj, "ServiceMonitor", meta, ownerRef, config.Labels)
+	return obj
+}
+
+// generatePrometheusRule 生成默认告警: 实例宕机, 内存使用率, 连接数, 拒绝连接, 集群状态
+func generatePrometheusRule(meta metav1.ObjectMeta, ownerRef metav1.OwnerReference, config *v1alpha1.PrometheusRuleConfig, apps []string, cluster bool) *unstructured.Unstructured {
+	selector := fmt.Sprintf(`namespace="%s",service=~"(%s)-metrics"`, meta.Namespace, strings.Join(apps, "|"))
+	alert := func(name, expr, duration, severity, summary string) interface{} {
+		return map[string]interface{}{
+			"alert": name,
+			"expr":  expr,
+			"for":   duration,
+			"labels": map[string]interface{}{
+				"severity": severity,
+			},
+			"annotations": map[string]interface{}{
+				"summary":     summary,
+				"description": "{{ $labels.namespace }}/{{ $labels.pod }}: " + summary,
+			},
+		}
+	}
+	rules := []interface{}{
+		alert("RedisDown", fmt.Sprintf("redis_up{%s} == 0", selector), "1m", "critical", "Redis instance is down"),
+		alert("RedisMemoryHigh", fmt.Sprintf("redis_memory_used_bytes{%[1]s} / redis_memory_max_bytes{%[1]s} > 0.9 and redis_memory_max_bytes{%[1]s} > 0", selector),
+			"5m", "warning", "Redis memory usage is above 90% of maxmemory"),
+		alert("RedisTooManyConnections", fmt.Sprintf("redis_connected_clients{%[1]s} / redis_config_maxclients{%[1]s} > 0.9", selector),
+			"5m", "warning", "Redis connected clients are above 90% of maxclients"),
+		alert("RedisRejectedConnections", fmt.Sprintf("increase(redis_rejected_connections_total{%s}[5m]) > 0", selector),
+			"0m", "warning", "Redis rejected connections"),
+	}
+	if cluster {
+		rules = append(rules, alert("RedisClusterStateNotOk", fmt.Sprintf("redis_cluster_state{%s} == 0", selector),
+			"1m", "critical", "Redis cluster state is not ok"))
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"groups": []interface{}{
+				map[string]interface{}{
+					"name":  meta.Name + ".rules",
+					"rules": rules,
+				},
+			},
+		},
+	}}
+	setMonitoringMeta(obj, "PrometheusRule", meta, ownerRef, config.Labels)
+	return obj
+}
+
+// setMonitoringMeta 设置prometheus-operator资源的元信息
+func setMonitoringMeta(obj *unstructured.Unstructured, kind string, meta metav1.ObjectMeta, ownerRef metav1.OwnerReference, labels map[string]string) {
+	obj.SetAPIVersion("monitoring.coreos.com/v1")
+	obj.SetKind(kind)
+	obj.SetName(meta.Name)
+	obj.SetNamespace(meta.Namespace)
+	obj.SetLabels(labels)
+	obj.SetOwnerReferences([]metav1.OwnerReference{ownerRef})
+}
+
+// createOrUpdateUnstructured 不存在时创建, 存在时覆盖spec
+func createOrUpdateUnstructured(ctx context.Context, obj *unstructured.Unstructured, cl client.Client) error {
+	logger := serviceLogger(obj.GetNamespace(), obj.GetName())
+	stored := &unstructured.Unstructured{}
+	stored.SetGroupVersionKind(obj.GroupVersionKind())
+	err := cl.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, stored)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "get monitoring resource failed", "kind", obj.GetKind())
+			return err
+		}
+		if err := cl.Create(ctx, obj); err != nil {
+			logger.Error(err, "create monitoring resource failed, is prometheus-operator installed?", "kind", obj.GetKind())
+			return err
+		}
+		logger.Info("create monitoring resource success", "kind", obj.GetKind())
+		return nil
+	}
+	if equality.Semantic.DeepEqual(stored.Object["spec"], obj.Object["spec"]) && equality.Semantic.DeepEqual(stored.GetLabels(), obj.GetLabels()) {
+		return nil
+	}
+	obj.SetResourceVersion(stored.GetResourceVersion())
+	if err := cl.Update(ctx, obj); err != nil {
+		logger.Error(err, "update monitoring resource failed", "kind", obj.GetKind())
+		return err
+	}
+	return nil
+}
+
+// deleteUnstructured 删除资源, 不存在或者没有安装CRD时忽略
+func deleteUnstructured(ctx context.Context, namespace, name string, gvk schema.GroupVersionKind, cl client.Client) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	err := cl.Delete(ctx, obj)
+	if err != nil && !errors.IsNotFound(err) && !apimeta.IsNoMatchError(err) {
+		serviceLogger(namespace, name).Error(err, "delete monitoring resource failed", "kind", gvk.Kind)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RedisAnnounceAddressAnnotation pod上记录已设置的cluster-announce地址(ip:port), 用于把CLUSTER NODES中的地址对应回pod
+	RedisAnnounceAddressAnnotation = "redis.yylover.announce-address"
+
+	redisBusPort               = 16379
+	redisExternalServiceLabel  = "redis_external_service"
+	statefulSetPodNameLabel    = "statefulset.kubernetes.io/pod-name"
+	redisExternalServiceSuffix = "-external"
+)
+
+// redisExternalAddress pod对外的地址
+type redisExternalAddress struct {
+	IP string
+	// Hostname LoadBalancer只分配了域名(比如AWS ELB)时使用, 只有7.x可以announce域名
+	Hostname string
+	Port     int32
+	BusPort  int32
+}
+
+// isRedisClusterExternal spec.service为NodePort或LoadBalancer时给每个pod创建对外的service
+func isRedisClusterExternal(cr *v1alpha1.RedisCluster) bool {
+	if cr.Spec.Service == nil {
+		return false
+	}
+	serviceType := generateServiceType(cr.Spec.Service.Type)
+	return serviceType == corev1.ServiceTypeNodePort || serviceType == corev1.ServiceTypeLoadBalancer
+}
+
+// ReconcileRedisClusterExternalAccess 给每个pod创建对外的service并设置cluster-announce-ip/port,
+// 缩容或关闭对外访问后删除多余的service, 关闭时清除announce配置
+func ReconcileRedisClusterExternalAccess(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	external := isRedisClusterExternal(cr)
+
+	desired := map[string]bool{}
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		if !external {
+			break
+		}
+		statefulName := cr.Name + "-" + role
+		replicas := RedisClusterSTS{RedisStatefulSetType: role}.getReplicaCount(cr)
+		for i := 0; i < int(*replicas); i++ {
+			podName := statefulName + "-" + strconv.Itoa(i)
+			service := generateRedisPodServiceDef(cr, role, podName)
+			desired[service.Name] = true
+			if err := createOrUpdateService(ctx, cr.Namespace, service, cl); err != nil {
+				logger.Error(err, "create redis pod external service failed", "pod", podName)
+				return err
+			}
+		}
+	}
+
+	services := &corev1.ServiceList{}
+	if err := cl.List(ctx, services, client.InNamespace(cr.Namespace), client.MatchingLabels{redisExternalServiceLabel: cr.Name}); err != nil {
+		logger.Error(err, "list redis external service failed")
+		return err
+	}
+	for _, service := range services.Items {
+		if desired[service.Name] {
+			continue
+		}
+		logger.Info("delete redis external service", "service", service.Name)
+		if err := deleteService(ctx, cr.Namespace, service.Name, cl); err != nil {
+			return err
+		}
+	}
+
+	pods, err := listRedisClusterPods(ctx, cr, cl)
+	if err != nil {
+		return err
+	}
+	//关闭对外访问时只需要清除设置过announce的pod, 注解在announce配置生效后才写入, 没有时不再访问redis
+	if !external && !hasRedisAnnouncedPod(pods) {
+		return nil
+	}
+	redis7 := isRedis7(cr.Status.RedisVersion)
+	var hostnameOnly []string
+	for i := range pods {
+		pod := &pods[i]
+		if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !IsPodReady(pod) {
+			continue
+		}
+		if !external && pod.Annotations[RedisAnnounceAddressAnnotation] == "" {
+			continue
+		}
+		var address *redisExternalAddress
+		if external {
+			if address, err = getRedisPodExternalAddress(ctx, cr.Namespace, pod, cl); err != nil {
+				return err
+			}
+			if address == nil {
+				logger.Info("external address of redis pod is not assigned yet", "pod", pod.Name)
+				continue
+			}
+			if address.IP == "" && !redis7 {
+				hostnameOnly = append(hostnameOnly, pod.Name)
+				continue
+			}
+		}
+		if err := applyRedisAnnounceConfig(pod.Status.PodIP, address); err != nil {
+			logger.Error(err, "set redis cluster announce address failed", "pod", pod.Name)
+			return err
+		}
+		//7.x由对外访问设置announce域名, 关闭后由ReconcileRedisClusterHostnames恢复
+		if redis7 && address != nil {
+			config := map[string]string{"cluster-announce-hostname": address.Hostname, "cluster-preferred-endpoint-type": "ip"}
+			if address.IP == "" {
+				config["cluster-preferred-endpoint-type"] = "hostname"
+			}
+			if err := applyRedisHostnameConfig(pod.Status.PodIP, config); err != nil {
+				logger.Error(err, "set redis cluster announce hostname failed", "pod", pod.Name)
+				return err
+			}
+		}
+		if err := setRedisAnnounceAnnotation(ctx, pod, address, cl); err != nil {
+			logger.Error(err, "patch redis pod announce annotation failed", "pod", pod.Name)
+			return err
+		}
+	}
+	if len(hostnameOnly) > 0 {
+		return fmt.Errorf("load balancer of redis pods %v only has a hostname, redis %s cannot announce it, 7.0 or later is required",
+			hostnameOnly, cr.Status.RedisVersion)
+	}
+	return nil
+}
+
+// hasRedisAnnouncedPod 是否有pod设置过announce地址
+func hasRedisAnnouncedPod(pods []corev1.Pod) bool {
+	for _, pod := range pods {
+		if pod.Annotations[RedisAnnounceAddressAnnotation] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// generateRedisPodServiceDef 生成只指向单个pod的对外service, 同时暴露客户端端口和集群总线端口
+func generateRedisPodServiceDef(cr *v1alpha1.RedisCluster, role, podName string) *corev1.Service {
+	labels := getRedisLabels(cr.Name+"-"+role, "cluster", role, cr.Labels)
+	labels[redisExternalServiceLabel] = cr.Name
+	service := &corev1.Service{
+		TypeMeta:   generateTypeMeta("Service", "core/v1"),
+		ObjectMeta: generateObjectMetaInformation(podName+redisExternalServiceSuffix, cr.Namespace, labels, generateServiceAnots(cr.ObjectMeta)),
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{statefulSetPodNameLabel: podName},
+			Ports: []corev1.ServicePort{
+				{Name: "redis-client", Port: redisPort, TargetPort: intstr.FromInt(redisPort), Protocol: corev1.ProtocolTCP},
+				{Name: "redis-bus", Port: redisBusPort, TargetPort: intstr.FromInt(redisBusPort), Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+	setRedisServiceSpec(service, cr.Spec.Service)
+	AddOwnerRefToObject(service, redisClusterAsOwner(cr))
+	return service
+}
+
+// listRedisClusterPods 获取集群leader和follower的pod
+func listRedisClusterPods(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) ([]corev1.Pod, error) {
+	pods := &corev1.PodList{}
+	if err := cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"redis_setup_type": "cluster"}); err != nil {
+		generateRedisManagerLogger(cr.Namespace, cr.Name).Error(err, "list redis cluster pods failed")
+		return nil, err
+	}
+	var res []corev1.Pod
+	for _, pod := range pods.Items {
+		if name, ok := GetRedisInstanceName(pod.Labels, "cluster"); ok && name == cr.Name {
+			res = append(res, pod)
+		}
+	}
+	return res, nil
+}
+
+// getRedisPodExternalAddress 获取pod对外的地址, LoadBalancer取ingress ip, 没有ip时取域名, NodePort取pod所在节点的地址, 未分配时返回nil
+func getRedisPodExternalAddress(ctx context.Context, namespace string, pod *corev1.Pod, cl client.Client) (*redisExternalAddress, error) {
+	service := &corev1.Service{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: pod.Name + redisExternalServiceSuffix}, service)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	address := &redisExternalAddress{}
+	switch service.Spec.Type {
+	case corev1.ServiceTypeLoadBalancer:
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				address.IP = ingress.IP
+				break
+			}
+			if address.Hostname == "" {
+				address.Hostname = ingress.Hostname
+			}
+		}
+		if address.IP != "" {
+			address.Hostname = ""
+		}
+		address.Port, address.BusPort = redisPort, redisBusPort
+	case corev1.ServiceTypeNodePort:
+		if pod.Spec.NodeName == "" {
+			return nil, nil
+		}
+		node := &corev1.Node{}
+		if err := cl.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, node); err != nil {
+			return nil, err
+		}
+		address.IP = getNodeAddress(node)
+		for _, port := range service.Spec.Ports {
+			switch port.Port {
+			case redisPort:
+				address.Port = port.NodePort
+			case redisBusPort:
+				address.BusPort = port.NodePort
+			}
+		}
+	}
+	if (address.IP == "" && address.Hostname == "") || address.Port == 0 || address.BusPort == 0 {
+		return nil, nil
+	}
+	return address, nil
+}
+
+// getNodeAddress 节点的对外地址, 没有ExternalIP时使用InternalIP
+func getNodeAddress(node *corev1.Node) string {
+	var internal string
+	for _, address := range node.Status.Addresses {
+		switch address.Type {
+		case corev1.NodeExternalIP:
+			return address.Address
+		case corev1.NodeInternalIP:
+			if internal == "" {
+				internal = address.Address
+			}
+		}
+	}
+	return internal
+}
+
+// applyRedisAnnounceConfig 对比CONFIG GET的结果设置cluster-announce-ip/port/bus-port, address为nil时清除
+func applyRedisAnnounceConfig(ip string, address *redisExternalAddress) error {
+	config := map[string]string{
+		"cluster-announce-ip":       "",
+		"cluster-announce-port":     "0",
+		"cluster-announce-bus-port": "0",
+	}
+	if address != nil {
+		config["cluster-announce-ip"] = address.IP
+		config["cluster-announce-port"] = strconv.Itoa(int(address.Port))
+		config["cluster-announce-bus-port"] = strconv.Itoa(int(address.BusPort))
+	}
+
+	redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+	defer redisClient.Close()
+	changed := false
+	for name, value := range config {
+		current, err := getRedisConfig(redisClient, name)
+		if err != nil {
+			return err
+		}
+		if current == value {
+			continue
+		}
+		if err := redisClient.ConfigSet(name, value).Err(); err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		return redisClient.ConfigRewrite().Err()
+	}
+	return nil
+}
+
+// setRedisAnnounceAnnotation 把announce地址记录到pod的注解上; 只announce域名时CLUSTER NODES中是pod ip和announce的端口
+func setRedisAnnounceAnnotation(ctx context.Context, pod *corev1.Pod, address *redisExternalAddress, cl client.Client) error {
+	value := ""
+	if address != nil && address.IP != "" {
+		value = generateRedisAddr(address.IP, int(address.Port))
+	} else if address != nil {
+		value = generateRedisAddr(pod.Status.PodIP, int(address.Port))
+	}
+	return patchRedisPodAnnotation(ctx, pod, RedisAnnounceAddressAnnotation, value, cl)
+}
+
+// translateRedisAnnouncedNodes 开启对外访问后CLUSTER NODES中是announce的地址, 按pod注解换回pod ip,
+// 其他按pod ip查找节点的逻辑不受影响
+func translateRedisAnnouncedNodes(ctx context.Context, cr *v1alpha1.RedisCluster, nodes [][]string, cl client.Client) error {
+	pods, err := listRedisClusterPods(ctx, cr, cl)
+	if err != nil {
+		return err
+	}
+	podIPs := map[string]string{}
+	for _, pod := range pods {
+		if announced := pod.Annotations[RedisAnnounceAddressAnnotation]; announced != "" && pod.Status.PodIP != "" {
+			podIPs[announced] = pod.Status.PodIP
+		}
+	}
+	if len(podIPs) == 0 {
+		return nil
+	}
+	for _, node := range nodes {
+		if len(node) < 2 {
+			continue
+		}
+		if podIP, ok := podIPs[strings.Split(node[1], "@")[0]]; ok {
+			node[1] = generateRedisAddr(podIP, redisPort) + "@" + strconv.Itoa(redisBusPort)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package k8sutil
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestGetRedisPodExternalAddressLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress []corev1.LoadBalancerIngress
+		want    *redisExternalAddress
+	}{
+		{name: "not assigned", want: nil},
+		{
+			name:    "ip",
+			ingress: []corev1.LoadBalancerIngress{{IP: "1.2.3.4"}},
+			want:    &redisExternalAddress{IP: "1.2.3.4", Port: redisPort, BusPort: redisBusPort},
+		},
+		{
+			name:    "hostname only",
+			ingress: []corev1.LoadBalancerIngress{{Hostname: "redis-0.elb.amazonaws.com"}},
+			want:    &redisExternalAddress{Hostname: "redis-0.elb.amazonaws.com", Port: redisPort, BusPort: redisBusPort},
+		},
+		{
+			name:    "ip preferred over hostname",
+			ingress: []corev1.LoadBalancerIngress{{Hostname: "redis-0.elb.amazonaws.com"}, {IP: "1.2.3.4"}},
+			want:    &redisExternalAddress{IP: "1.2.3.4", Port: redisPort, BusPort: redisBusPort},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "redis-leader-0"}}
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: pod.Name + redisExternalServiceSuffix},
+				Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+				Status:     corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: tt.ingress}},
+			}
+			cl := fake.NewClientBuilder().WithObjects(service).Build()
+			got, err := getRedisPodExternalAddress(context.Background(), "default", pod, cl)
+			if err != nil {
+				t.Fatalf("getRedisPodExternalAddress() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getRedisPodExternalAddress() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
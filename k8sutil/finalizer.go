@@ -2,32 +2,45 @@ package k8sutil
 
 import (
 	"context"
+	"strconv"
+	"strings"
+
 	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 const (
-	RedisSingleFinalizer = "redis_finalizer"
+	RedisSingleFinalizer  = "redis_finalizer"
+	RedisClusterFinalizer = "redis_cluster_finalizer"
+	RedisBackupFinalizer  = "redis_backup_finalizer"
+	RedisUserFinalizer    = "redis_user_finalizer"
 )
 
 // HandleRedisFinalizer判断是否删除，是否需要执行finalizer
-func HandleRedisFinalizer(single *v1alpha1.RedisSingle, cl client.Client) error {
+func HandleRedisFinalizer(ctx context.Context, single *v1alpha1.RedisSingle, cl client.Client) error {
 	//要删除
 	if single.GetDeletionTimestamp() != nil {
 		if controllerutil.ContainsFinalizer(single, RedisSingleFinalizer) {
-			if err := finalizeRedisServices(single); err != nil {
+			if err := finalizeRedisServices(ctx, single.Namespace, []string{single.Name, single.Name + "-headless", single.Name + "-metrics"}, cl); err != nil {
 				return err
 			}
 
-			if err := finalizeRedisPVC(single); err != nil {
+			//未设置deletionPolicy时保持原有行为, 除非whenDeleted为Retain都删除PVC
+			deleteByDefault := single.Spec.Storage == nil || single.Spec.Storage.PersistentVolumeClaimRetentionPolicy == nil ||
+				single.Spec.Storage.PersistentVolumeClaimRetentionPolicy.WhenDeleted != v1alpha1.PVCRetentionRetain
+			done, err := finalizeRedisData(ctx, single, "RedisSingle", single.Spec.DeletionPolicy, single.Spec.Backup, deleteByDefault,
+				[]map[string]string{getRedisSelectorLabels(single.Name, "standalone", "standalone")}, cl)
+			if err != nil || !done {
 				return err
 			}
 
 			controllerutil.RemoveFinalizer(single, RedisSingleFinalizer)
-			if err := cl.Update(context.TODO(), single); err != nil {
+			if err := cl.Update(ctx, single); err != nil {
 				return err
 			}
 		}
@@ -36,36 +49,287 @@ func HandleRedisFinalizer(single *v1alpha1.RedisSingle, cl client.Client) error
 }
 
 //AddRedisFinalizer 增加finalizer
-func AddRedisFinalizer(single *v1alpha1.RedisSingle, cl client.Client) error {
+func AddRedisFinalizer(ctx context.Context, single *v1alpha1.RedisSingle, cl client.Client) error {
 	logger := getStatefulLog(single.Namespace, single.Name)
 	if !controllerutil.ContainsFinalizer(single, RedisSingleFinalizer) {
 		logger.Info("add redis finalizer success")
 		controllerutil.AddFinalizer(single, RedisSingleFinalizer)
-		return cl.Update(context.TODO(), single)
+		return cl.Update(ctx, single)
 	}
 	logger.Info("redis finalizer exists")
 	return nil
 }
 
-// finalizeRedisServices 处理service
-func finalizeRedisServices(single *v1alpha1.RedisSingle) error {
-	serviceName, headlessServiceName := single.Name, single.Name+"-headless"
-	logger := getStatefulLog(single.Namespace, single.Name)
-	logger.Info("redis finalizer delete service:", "serviceName", serviceName, "headlessServiceName", headlessServiceName)
-	for _, svc := range []string{serviceName, headlessServiceName} {
-		err := generateK8sClient().CoreV1().Services(single.Namespace).Delete(context.TODO(), svc, metav1.DeleteOptions{})
+// HandleRedisClusterFinalizer 删除集群时清理leader和follower的service、ConfigMap, 并按deletionPolicy处理PVC
+func HandleRedisClusterFinalizer(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	if cr.GetDeletionTimestamp() != nil {
+		if controllerutil.ContainsFinalizer(cr, RedisClusterFinalizer) {
+			var services []string
+			var selectors []map[string]string
+			for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+				statefulName := cr.Name + "-" + role
+				selectors = append(selectors, getRedisSelectorLabels(statefulName, "cluster", role))
+				services = append(services, statefulName, statefulName+"-headless", statefulName+"-metrics")
+			}
+			if err := finalizeRedisServices(ctx, cr.Namespace, services, cl); err != nil {
+				return err
+			}
+
+			//未设置deletionPolicy时PVC由whenDeleted决定
+			done, err := finalizeRedisData(ctx, cr, "RedisCluster", cr.Spec.DeletionPolicy, cr.Spec.Backup, false, selectors, cl)
+			if err != nil || !done {
+				return err
+			}
+
+			controllerutil.RemoveFinalizer(cr, RedisClusterFinalizer)
+			if err := cl.Update(ctx, cr); err != nil {
+				return err
+			}
+			deleteRedisClusterMetrics(cr)
+		}
+	}
+	return nil
+}
+
+// AddRedisClusterFinalizer 增加集群的finalizer
+func AddRedisClusterFinalizer(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	if !controllerutil.ContainsFinalizer(cr, RedisClusterFinalizer) {
+		controllerutil.AddFinalizer(cr, RedisClusterFinalizer)
+		return cl.Update(ctx, cr)
+	}
+	return nil
+}
+
+// finalizeRedisServices 删除service, 不存在时忽略
+func finalizeRedisServices(ctx context.Context, namespace string, services []string, cl client.Client) error {
+	logger := getStatefulLog(namespace, services[0])
+	logger.Info("redis finalizer delete service:", "services", services)
+	for _, svc := range services {
+		if err := deleteService(ctx, namespace, svc, cl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizeRedisData 按deletionPolicy处理statefulSet的PVC和ConfigMap, selectors为每个statefulSet的标签,
+// Snapshot时备份未结束返回false
+func finalizeRedisData(ctx context.Context, source metav1.Object, kind, policy string, schedule *v1alpha1.BackupSchedule, deleteByDefault bool, selectors []map[string]string, cl client.Client) (bool, error) {
+	logger := getStatefulLog(source.GetNamespace(), source.GetName())
+	deleteData := deleteByDefault
+	switch policy {
+	case v1alpha1.DeletionPolicyRetain:
+		deleteData = false
+	case v1alpha1.DeletionPolicyDelete:
+		deleteData = true
+	case v1alpha1.DeletionPolicySnapshot:
+		phase, err := ensureRedisFinalSnapshot(ctx, source, kind, schedule, cl)
+		if err != nil {
+			return false, err
+		}
+		switch phase {
+		case v1alpha1.BackupPhaseCompleted:
+			deleteData = true
+		case v1alpha1.BackupPhaseFailed:
+			logger.Info("redis final snapshot failed, retain PVC")
+			deleteData = false
+		default:
+			logger.Info("waiting for redis final snapshot")
+			return false, nil
+		}
+	}
+
+	for _, selector := range selectors {
+		if err := finalizeRedisConfigMaps(ctx, source, selector, cl); err != nil {
+			return false, err
+		}
+		if deleteData {
+			if err := finalizeRedisPVC(ctx, source, selector, cl); err != nil {
+				return false, err
+			}
+		} else if policy != "" {
+			//Retain时去掉whenDeleted加上的ownerReference, 避免被GC删除
+			if err := releaseRedisPVC(ctx, source, selector, cl); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// ensureRedisFinalSnapshot 创建删除前的最后一次备份并返回备份状态, 没有配置backup时按失败处理
+func ensureRedisFinalSnapshot(ctx context.Context, source metav1.Object, kind string, schedule *v1alpha1.BackupSchedule, cl client.Client) (string, error) {
+	logger := getStatefulLog(source.GetNamespace(), source.GetName())
+	if schedule == nil {
+		logger.Info("deletionPolicy Snapshot requires spec.backup.storage")
+		return v1alpha1.BackupPhaseFailed, nil
+	}
+	name := source.GetName() + "-final-" + string(source.GetUID())[:8]
+	backup := &v1alpha1.RedisBackup{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: source.GetNamespace(), Name: name}, backup)
+	if err == nil {
+		return backup.Status.Phase, nil
+	}
+	if !errors.IsNotFound(err) {
+		return "", err
+	}
+	backup = &v1alpha1.RedisBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: source.GetNamespace(),
+		},
+		Spec: v1alpha1.RedisBackupSpec{
+			Source:  v1alpha1.BackupSource{Kind: kind, Name: source.GetName()},
+			Storage: schedule.Storage,
+		},
+	}
+	logger.Info("create redis final snapshot", "backup", name)
+	if err := cl.Create(ctx, backup); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+	return "", nil
+}
+
+// listRedisPVC 按标签获取statefulSet的PVC
+func listRedisPVC(ctx context.Context, namespace string, selector map[string]string, cl client.Client) ([]corev1.PersistentVolumeClaim, error) {
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	if err := cl.List(ctx, pvcs, client.InNamespace(namespace), client.MatchingLabels(selector)); err != nil {
+		return nil, err
+	}
+	return pvcs.Items, nil
+}
+
+// isRedisStatefulPVC PVC是否属于source: ownerReference指向source, 或者名称为statefulSet生成的<name>-<name>-<ordinal>
+func isRedisStatefulPVC(pvc *corev1.PersistentVolumeClaim, source metav1.Object, statefulName string) bool {
+	if isOwnedBy(pvc, source.GetUID()) {
+		return true
+	}
+	prefix := statefulName + "-" + statefulName + "-"
+	if !strings.HasPrefix(pvc.Name, prefix) {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(pvc.Name, prefix))
+	return err == nil
+}
+
+// finalizeRedisPVC 删除statefulSet的所有PVC, 不存在时忽略
+func finalizeRedisPVC(ctx context.Context, source metav1.Object, selector map[string]string, cl client.Client) error {
+	statefulName := selector["app"]
+	logger := getStatefulLog(source.GetNamespace(), statefulName)
+	pvcs, err := listRedisPVC(ctx, source.GetNamespace(), selector, cl)
+	if err != nil {
+		logger.Error(err, "redis finalizer list PVC failed")
+		return err
+	}
+	for i := range pvcs {
+		if !isRedisStatefulPVC(&pvcs[i], source, statefulName) {
+			continue
+		}
+		logger.Info("redis finalizer delete PVC:", "pvcName", pvcs[i].Name)
+		err := cl.Delete(ctx, &pvcs[i])
 		if err != nil && !errors.IsNotFound(err) {
-			logger.Error(err, "Redis finalizer delte serice err :", err.Error())
 			return err
 		}
 	}
 	return nil
 }
 
-// finalizeRedisPVC 删除RedisPVC
-func finalizeRedisPVC(single *v1alpha1.RedisSingle) error {
-	PVCName := single.Name + "-" + single.Name + "-0"
-	logger := getStatefulLog(single.Namespace, single.Name)
-	logger.Info("redis finalizer delete PVC:", "pvcName", PVCName)
-	return generateK8sClient().CoreV1().PersistentVolumeClaims(single.Namespace).Delete(context.TODO(), PVCName, metav1.DeleteOptions{})
+// releaseRedisPVC 去掉PVC上指向CR的ownerReference
+func releaseRedisPVC(ctx context.Context, source metav1.Object, selector map[string]string, cl client.Client) error {
+	pvcs, err := listRedisPVC(ctx, source.GetNamespace(), selector, cl)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		var ownerRefs []metav1.OwnerReference
+		for _, ref := range pvc.OwnerReferences {
+			if ref.UID != source.GetUID() {
+				ownerRefs = append(ownerRefs, ref)
+			}
+		}
+		if len(ownerRefs) == len(pvc.OwnerReferences) {
+			continue
+		}
+		pvc.OwnerReferences = ownerRefs
+		if err := cl.Update(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// finalizeRedisConfigMaps 删除operator为statefulSet生成的ConfigMap, 用户自己的ConfigMap即使带有相同的标签也不受影响
+func finalizeRedisConfigMaps(ctx context.Context, source metav1.Object, selector map[string]string, cl client.Client) error {
+	statefulName := selector["app"]
+	logger := getStatefulLog(source.GetNamespace(), statefulName)
+	configMaps := &corev1.ConfigMapList{}
+	if err := cl.List(ctx, configMaps, client.InNamespace(source.GetNamespace()), client.MatchingLabels(selector)); err != nil {
+		logger.Error(err, "redis finalizer list configmap failed")
+		return err
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if configMap.Name != statefulName+generatedConfigSuffix || !isOwnedBy(configMap, source.GetUID()) {
+			continue
+		}
+		logger.Info("redis finalizer delete configmap:", "configMap", configMap.Name)
+		if err := cl.Delete(ctx, configMap); err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "redis finalizer delete configmap failed")
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleRedisBackupFinalizer 删除RedisBackup时先清理对象存储中的备份文件
+func HandleRedisBackupFinalizer(ctx context.Context, backup *v1alpha1.RedisBackup, cl client.Client) error {
+	if backup.GetDeletionTimestamp() != nil {
+		if controllerutil.ContainsFinalizer(backup, RedisBackupFinalizer) {
+			if err := DeleteRedisBackupObjects(ctx, backup, cl); err != nil {
+				return err
+			}
+
+			controllerutil.RemoveFinalizer(backup, RedisBackupFinalizer)
+			if err := cl.Update(ctx, backup); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddRedisBackupFinalizer 增加备份的finalizer
+func AddRedisBackupFinalizer(ctx context.Context, backup *v1alpha1.RedisBackup, cl client.Client) error {
+	if !controllerutil.ContainsFinalizer(backup, RedisBackupFinalizer) {
+		controllerutil.AddFinalizer(backup, RedisBackupFinalizer)
+		return cl.Update(ctx, backup)
+	}
+	return nil
+}
+
+// HandleRedisUserFinalizer 删除RedisUser时在目标redis的节点上删除该用户
+func HandleRedisUserFinalizer(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) error {
+	if user.GetDeletionTimestamp() != nil {
+		if controllerutil.ContainsFinalizer(user, RedisUserFinalizer) {
+			if err := DeleteRedisUser(ctx, user, cl); err != nil {
+				return err
+			}
+
+			controllerutil.RemoveFinalizer(user, RedisUserFinalizer)
+			if err := cl.Update(ctx, user); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddRedisUserFinalizer 增加用户的finalizer
+func AddRedisUserFinalizer(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) error {
+	if !controllerutil.ContainsFinalizer(user, RedisUserFinalizer) {
+		controllerutil.AddFinalizer(user, RedisUserFinalizer)
+		return cl.Update(ctx, user)
+	}
+	return nil
 }
@@ -1,8 +1,11 @@
 package k8sutil
 
 import (
+	"strings"
+
 	"github.com/yylover/memcached-operator/api/v1alpha1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // LabelSelectors generates object for label selection
@@ -47,16 +50,46 @@ func filterAnnotations(anots map[string]string) map[string]string {
 	return anots
 }
 
+// getRedisLabels 生成redis对象的标签, CR上的标签不能覆盖operator用于查找对象的标签
 func getRedisLabels(name, setupType, role string, labels map[string]string) map[string]string {
-	lbls := map[string]string{
+	lbls := map[string]string{}
+	for k, v := range labels {
+		lbls[k] = v
+	}
+	for k, v := range getRedisSelectorLabels(name, setupType, role) {
+		lbls[k] = v
+	}
+	return lbls
+}
+
+// getRedisSelectorLabels 定位statefulSet所属对象的标签, app会和其他CR重名, 需要同时匹配setup类型和角色
+func getRedisSelectorLabels(name, setupType, role string) map[string]string {
+	return map[string]string{
 		"app":              name,
 		"redis_setup_type": setupType,
 		"role":             role,
 	}
-	for k, v := range labels {
-		lbls[k] = v
+}
+
+// isOwnedBy 对象的ownerReference是否指向uid
+func isOwnedBy(obj metav1.Object, uid types.UID) bool {
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID == uid {
+			return true
+		}
 	}
-	return lbls
+	return false
+}
+
+// GetRedisInstanceName 根据pod的标签获取所属CR的名称, 集群的app标签为<name>-<role>, setupType不匹配时返回false
+func GetRedisInstanceName(labels map[string]string, setupType string) (string, bool) {
+	if labels["redis_setup_type"] != setupType || labels["app"] == "" {
+		return "", false
+	}
+	if setupType == "cluster" {
+		return strings.TrimSuffix(labels["app"], "-"+labels["role"]), true
+	}
+	return labels["app"], true
 }
 
 // generateObjectMetaInformation生成对象meta信息
@@ -93,6 +126,30 @@ func redisClusterAsOwner(cr *v1alpha1.RedisCluster) metav1.OwnerReference {
 	}
 }
 
+// redisReplicationAsOwner生成对象引用
+func redisReplicationAsOwner(cr *v1alpha1.RedisReplication) metav1.OwnerReference {
+	trueVar := true
+	return metav1.OwnerReference{
+		APIVersion: cr.APIVersion,
+		Kind:       cr.Kind,
+		Name:       cr.Name,
+		UID:        cr.UID,
+		Controller: &trueVar,
+	}
+}
+
+// redisSentinelAsOwner生成对象引用
+func redisSentinelAsOwner(cr *v1alpha1.RedisSentinel) metav1.OwnerReference {
+	trueVar := true
+	return metav1.OwnerReference{
+		APIVersion: cr.APIVersion,
+		Kind:       cr.Kind,
+		Name:       cr.Name,
+		UID:        cr.UID,
+		Controller: &trueVar,
+	}
+}
+
 // AddOwnerRefToObject add
 func AddOwnerRefToObject(obj metav1.Object, ownerRef metav1.OwnerReference) {
 	obj.SetOwnerReferences(append(obj.GetOwnerReferences(), ownerRef))
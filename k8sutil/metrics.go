@@ -0,0 +1,228 @@
+package k8sutil
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+var (
+	redisClusterSlotsCovered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_operator_cluster_slots_covered",
+		Help: "Number of hash slots served by healthy masters of the redis cluster.",
+	}, []string{"namespace", "name"})
+	redisClusterFailedNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "redis_operator_cluster_failed_nodes",
+		Help: "Number of failed or disconnected nodes of the redis cluster.",
+	}, []string{"namespace", "name"})
+	redisClusterOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_operator_cluster_operations_total",
+		Help: "Number of failover and repair operations executed on the redis cluster.",
+	}, []string{"namespace", "name", "operation", "result"})
+	redisExecDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_operator_exec_duration_seconds",
+		Help:    "Duration of commands executed in redis pods.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"command"})
+	redisExecFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_operator_exec_failures_total",
+		Help: "Number of failed commands executed in redis pods.",
+	}, []string{"command"})
+
+	redisInstancesDesc = prometheus.NewDesc("redis_operator_managed_instances",
+		"Number of redis resources managed by the operator.", []string{"kind", "phase"}, nil)
+)
+
+const (
+	redisOperationFailover = "failover"
+	redisOperationRepair   = "repair"
+)
+
+// RegisterRedisMetrics 把operator的指标注册到manager的registry, 实例数量在采集时从reader(缓存)中统计
+func RegisterRedisMetrics(registry prometheus.Registerer, reader client.Reader) {
+	registry.MustRegister(
+		redisClusterSlotsCovered,
+		redisClusterFailedNodes,
+		redisClusterOperations,
+		redisExecDuration,
+		redisExecFailures,
+		&redisInstanceCollector{reader: reader},
+	)
+}
+
+// observeRedisExec 记录在pod中执行命令的耗时和失败次数
+func observeRedisExec(cmd []string, start time.Time, err error) {
+	command := ""
+	if len(cmd) > 0 {
+		command = cmd[0]
+	}
+	redisExecDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	if err != nil {
+		redisExecFailures.WithLabelValues(command).Inc()
+	}
+}
+
+// observeRedisClusterOperation 记录故障切换和修复操作
+func observeRedisClusterOperation(cr *v1alpha1.RedisCluster, operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	redisClusterOperations.WithLabelValues(cr.Namespace, cr.Name, operation, result).Inc()
+}
+
+// setRedisClusterStateMetrics 根据CLUSTER NODES的结果更新slot覆盖数和失败节点数
+func setRedisClusterStateMetrics(cr *v1alpha1.RedisCluster, nodes [][]string, failed int) {
+	redisClusterSlotsCovered.WithLabelValues(cr.Namespace, cr.Name).Set(float64(countRedisClusterSlots(nodes)))
+	redisClusterFailedNodes.WithLabelValues(cr.Namespace, cr.Name).Set(float64(failed))
+}
+
+// deleteRedisClusterMetrics 集群删除后清理按实例区分的指标
+func deleteRedisClusterMetrics(cr *v1alpha1.RedisCluster) {
+	redisClusterSlotsCovered.DeleteLabelValues(cr.Namespace, cr.Name)
+	redisClusterFailedNodes.DeleteLabelValues(cr.Namespace, cr.Name)
+	for _, operation := range []string{redisOperationFailover, redisOperationRepair} {
+		for _, result := range []string{"success", "failure"} {
+			redisClusterOperations.DeleteLabelValues(cr.Namespace, cr.Name, operation, result)
+		}
+	}
+}
+
+// countRedisClusterSlots 统计健康master上分配的slot数, 迁移中的slot([slot->-node])不计入
+func countRedisClusterSlots(nodes [][]string) int {
+	covered := 0
+	for _, node := range nodes {
+		if len(node) < 9 || !strings.Contains(node[2], "master") || strings.Contains(node[2], "fail") {
+			continue
+		}
+		for _, slots := range node[8:] {
+			if strings.HasPrefix(slots, "[") {
+				continue
+			}
+			bounds := strings.SplitN(slots, "-", 2)
+			first, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				continue
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = strconv.Atoi(bounds[1]); err != nil {
+					continue
+				}
+			}
+			covered += last - first + 1
+		}
+	}
+	if covered > redisClusterSlots {
+		covered = redisClusterSlots
+	}
+	return covered
+}
+
+// redisInstanceCollector 采集时统计各类CR的数量
+type redisInstanceCollector struct {
+	reader client.Reader
+}
+
+func (c *redisInstanceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- redisInstancesDesc
+}
+
+func (c *redisInstanceCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logger := logf.Log.WithName("metrics")
+	counts := map[string]map[string]int{}
+	count := func(kind, phase string) {
+		if counts[kind] == nil {
+			counts[kind] = map[string]int{}
+		}
+		counts[kind][phase]++
+	}
+
+	singles := &v1alpha1.RedisSingleList{}
+	if err := c.reader.List(ctx, singles); err != nil {
+		logger.Error(err, "list redis single failed")
+	}
+	for i := range singles.Items {
+		count("RedisSingle", getRedisInstancePhase(&singles.Items[i], singles.Items[i].Status.Conditions))
+	}
+	clusters := &v1alpha1.RedisClusterList{}
+	if err := c.reader.List(ctx, clusters); err != nil {
+		logger.Error(err, "list redis cluster failed")
+	}
+	for _, cluster := range clusters.Items {
+		count("RedisCluster", getRedisClusterPhase(&cluster))
+	}
+	replications := &v1alpha1.RedisReplicationList{}
+	if err := c.reader.List(ctx, replications); err != nil {
+		logger.Error(err, "list redis replication failed")
+	}
+	for i := range replications.Items {
+		count("RedisReplication", getRedisInstancePhase(&replications.Items[i], replications.Items[i].Status.Conditions))
+	}
+	sentinels := &v1alpha1.RedisSentinelList{}
+	if err := c.reader.List(ctx, sentinels); err != nil {
+		logger.Error(err, "list redis sentinel failed")
+	}
+	for _, sentinel := range sentinels.Items {
+		phase := "Pending"
+		if sentinel.DeletionTimestamp != nil {
+			phase = "Deleting"
+		} else if sentinel.Status.MasterAddress != "" {
+			phase = "Ready"
+		}
+		count("RedisSentinel", phase)
+	}
+	backups := &v1alpha1.RedisBackupList{}
+	if err := c.reader.List(ctx, backups); err != nil {
+		logger.Error(err, "list redis backup failed")
+	}
+	for _, backup := range backups.Items {
+		phase := backup.Status.Phase
+		if phase == "" {
+			phase = "Pending"
+		}
+		count("RedisBackup", phase)
+	}
+
+	for kind, phases := range counts {
+		for phase, n := range phases {
+			ch <- prometheus.MustNewConstMetric(redisInstancesDesc, prometheus.GaugeValue, float64(n), kind, phase)
+		}
+	}
+}
+
+// getRedisClusterPhase 集群使用status.phase中持久化的阶段
+func getRedisClusterPhase(cr *v1alpha1.RedisCluster) string {
+	if cr.DeletionTimestamp != nil {
+		return "Deleting"
+	}
+	if cr.Status.Phase == "" {
+		return "Pending"
+	}
+	return cr.Status.Phase
+}
+
+// getRedisInstancePhase 根据删除时间和Reconciled condition得到实例所处的阶段
+func getRedisInstancePhase(obj metav1.Object, conditions []metav1.Condition) string {
+	if obj.GetDeletionTimestamp() != nil {
+		return "Deleting"
+	}
+	condition := meta.FindStatusCondition(conditions, v1alpha1.ConditionReconciled)
+	if condition == nil {
+		return "Pending"
+	}
+	if condition.Status == metav1.ConditionTrue {
+		return "Ready"
+	}
+	return "Failed"
+}
@@ -1,8 +1,110 @@
 package k8sutil
 
-import "github.com/yylover/memcached-operator/api/v1alpha1"
+import (
+	"context"
+	"fmt"
 
-func ReconcileRedisPodDisruptionBudget(cr *v1alpha1.RedisCluster, role string) error {
-	//podName := cr.ObjectMeta.Name+"-"+role
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ReconcileRedisPodDisruptionBudget 为集群的leader或follower创建<name>-<role>的PDB, 未配置时删除
+func ReconcileRedisPodDisruptionBudget(ctx context.Context, cr *v1alpha1.RedisCluster, role string, cl client.Client) error {
+	pdbName := cr.ObjectMeta.Name + "-" + role
+	pdbSpec := cr.Spec.RedisLeader.PodDisruptionBudget
+	if role == ClusterRoleFollower {
+		pdbSpec = cr.Spec.RedisFollower.PodDisruptionBudget
+	}
+	labels := getRedisLabels(pdbName, "cluster", role, cr.ObjectMeta.GetLabels())
+	return reconcilePodDisruptionBudget(ctx, cr.Namespace, generateObjectMetaInformation(pdbName, cr.Namespace, labels, generateStatefulSetsAnots(cr.ObjectMeta)), redisClusterAsOwner(cr), pdbSpec, cl)
+}
+
+// ReconcileRedisSinglePodDisruptionBudget 为单例创建PDB, 未配置时删除
+func ReconcileRedisSinglePodDisruptionBudget(ctx context.Context, cr *v1alpha1.RedisSingle, cl client.Client) error {
+	labels := getRedisLabels(cr.Name, "standalone", "standalone", cr.ObjectMeta.GetLabels())
+	return reconcilePodDisruptionBudget(ctx, cr.Namespace, generateObjectMetaInformation(cr.Name, cr.Namespace, labels, generateStatefulSetsAnots(cr.ObjectMeta)), redisAsOwner(cr), cr.Spec.PodDisruptionBudget, cl)
+}
+
+// reconcilePodDisruptionBudget 创建、更新或删除PDB
+func reconcilePodDisruptionBudget(ctx context.Context, namespace string, pdbMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference, pdbSpec *v1alpha1.PodDisruptionBudget, cl client.Client) error {
+	logger := getStatefulLog(namespace, pdbMeta.Name)
+	if pdbSpec == nil {
+		//只删除operator创建的PDB, 用户自己创建的同名PDB保留
+		pdb := &policyv1.PodDisruptionBudget{}
+		err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: pdbMeta.Name}, pdb)
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			logger.Error(err, "Redis PodDisruptionBudget get failed")
+			return err
+		}
+		if !isOwnedBy(pdb, ownerDef.UID) {
+			return nil
+		}
+		if err := cl.Delete(ctx, pdb); err != nil && !errors.IsNotFound(err) {
+			logger.Error(err, "Redis PodDisruptionBudget delete failed")
+			return err
+		}
+		return nil
+	}
+
+	pdbDef, err := generatePodDisruptionBudgetDef(pdbMeta, ownerDef, pdbSpec)
+	if err != nil {
+		logger.Error(err, "invalid Redis PodDisruptionBudget")
+		return err
+	}
+	storedPDB := &policyv1.PodDisruptionBudget{}
+	err = cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: pdbMeta.Name}, storedPDB)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			logger.Error(err, "Redis PodDisruptionBudget get failed")
+			return err
+		}
+		if err := cl.Create(ctx, pdbDef); err != nil {
+			logger.Error(err, "Redis PodDisruptionBudget create failed")
+			return err
+		}
+		logger.Info("Redis PodDisruptionBudget create success")
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(storedPDB.Spec, pdbDef.Spec) && equality.Semantic.DeepEqual(storedPDB.Labels, pdbDef.Labels) {
+		return nil
+	}
+	pdbDef.ResourceVersion = storedPDB.ResourceVersion
+	if err := cl.Update(ctx, pdbDef); err != nil {
+		logger.Error(err, "Redis PodDisruptionBudget update failed")
+		return err
+	}
+	logger.Info("Redis PodDisruptionBudget update success")
 	return nil
 }
+
+// generatePodDisruptionBudgetDef 生成PDB定义, 两个字段都未设置时默认maxUnavailable为1
+func generatePodDisruptionBudgetDef(pdbMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference, pdbSpec *v1alpha1.PodDisruptionBudget) (*policyv1.PodDisruptionBudget, error) {
+	if pdbSpec.MinAvailable != nil && pdbSpec.MaxUnavailable != nil {
+		return nil, fmt.Errorf("minAvailable and maxUnavailable cannot be both set")
+	}
+	pdb := &policyv1.PodDisruptionBudget{
+		TypeMeta:   generateTypeMeta("PodDisruptionBudget", "policy/v1"),
+		ObjectMeta: pdbMeta,
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			Selector:       LabelSelectors(pdbMeta.GetLabels()),
+			MinAvailable:   pdbSpec.MinAvailable,
+			MaxUnavailable: pdbSpec.MaxUnavailable,
+		},
+	}
+	if pdb.Spec.MinAvailable == nil && pdb.Spec.MaxUnavailable == nil {
+		maxUnavailable := intstr.FromInt(1)
+		pdb.Spec.MaxUnavailable = &maxUnavailable
+	}
+	AddOwnerRefToObject(pdb, ownerDef)
+	return pdb, nil
+}
@@ -0,0 +1,42 @@
+package k8sutil
+
+import (
+	"context"
+	"testing"
+
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestReconcilePodDisruptionBudgetDelete(t *testing.T) {
+	owner := metav1.OwnerReference{APIVersion: "testop.yylover.com/v1alpha1", Kind: "RedisCluster", Name: "redis", UID: "redis-uid"}
+	tests := []struct {
+		name    string
+		owners  []metav1.OwnerReference
+		deleted bool
+	}{
+		{name: "owned pdb is deleted", owners: []metav1.OwnerReference{owner}, deleted: true},
+		{name: "user pdb is kept", deleted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdb := &policyv1.PodDisruptionBudget{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "redis-leader", OwnerReferences: tt.owners}}
+			cl := fake.NewClientBuilder().WithObjects(pdb).Build()
+			pdbMeta := metav1.ObjectMeta{Namespace: "default", Name: "redis-leader"}
+			if err := reconcilePodDisruptionBudget(context.Background(), "default", pdbMeta, owner, nil, cl); err != nil {
+				t.Fatalf("reconcilePodDisruptionBudget() error = %v", err)
+			}
+			err := cl.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "redis-leader"}, &policyv1.PodDisruptionBudget{})
+			if deleted := errors.IsNotFound(err); deleted != tt.deleted {
+				t.Errorf("pdb deleted = %v, want %v (err %v)", deleted, tt.deleted, err)
+			}
+		})
+	}
+	cl := fake.NewClientBuilder().Build()
+	if err := reconcilePodDisruptionBudget(context.Background(), "default", metav1.ObjectMeta{Namespace: "default", Name: "redis-leader"}, owner, nil, cl); err != nil {
+		t.Errorf("reconcilePodDisruptionBudget() without pdb error = %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// StorageExpansionError PVC扩容失败, 调谐需要报告失败而不是跳过
+type StorageExpansionError struct {
+	Err error
+}
+
+func (e *StorageExpansionError) Error() string {
+	return "redis storage expansion failed: " + e.Err.Error()
+}
+
+func (e *StorageExpansionError) Unwrap() error {
+	return e.Err
+}
+
+// getPVCStorageRequest 获取PVC模板申请的存储大小
+func getPVCStorageRequest(pvc corev1.PersistentVolumeClaim) (int64, bool) {
+	size, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if !ok {
+		return 0, false
+	}
+	return size.Value(), true
+}
+
+// isStatefulSetStorageExpanded 判断新的PVC模板是否扩容, 缩容不支持, 只记录日志
+func isStatefulSetStorageExpanded(storedStateful, newStateful *appsv1.StatefulSet) bool {
+	if len(storedStateful.Spec.VolumeClaimTemplates) == 0 || len(newStateful.Spec.VolumeClaimTemplates) == 0 {
+		return false
+	}
+	storedSize, ok := getPVCStorageRequest(storedStateful.Spec.VolumeClaimTemplates[0])
+	if !ok {
+		return false
+	}
+	newSize, ok := getPVCStorageRequest(newStateful.Spec.VolumeClaimTemplates[0])
+	if !ok {
+		return false
+	}
+	if newSize < storedSize {
+		getStatefulLog(storedStateful.Namespace, storedStateful.Name).Info("redis storage cannot be shrunk, ignore the new size",
+			"current", storedStateful.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests.Storage().String(),
+			"desired", newStateful.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests.Storage().String())
+	}
+	return newSize > storedSize
+}
+
+// expandStatefulSetPVCs 按新的模板扩容已有的PVC, StorageClass不允许扩容时返回错误
+func expandStatefulSetPVCs(ctx context.Context, namespace string, storedStateful, newStateful *appsv1.StatefulSet, cl client.Client) error {
+	logger := getStatefulLog(namespace, storedStateful.Name)
+	template := newStateful.Spec.VolumeClaimTemplates[0]
+	size := template.Spec.Resources.Requests[corev1.ResourceStorage]
+	pvcs, err := listStatefulSetPVCs(ctx, namespace, storedStateful, cl)
+	if err != nil {
+		return err
+	}
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		current, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		if ok && current.Cmp(size) >= 0 {
+			continue
+		}
+		if err := checkStorageClassExpansion(ctx, pvc, cl); err != nil {
+			logger.Error(err, "redis pvc cannot be expanded", "pvc", pvc.Name)
+			return err
+		}
+		if pvc.Spec.Resources.Requests == nil {
+			pvc.Spec.Resources.Requests = corev1.ResourceList{}
+		}
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = size
+		logger.Info("expand redis pvc", "pvc", pvc.Name, "size", size.String())
+		if err := cl.Update(ctx, pvc); err != nil {
+			logger.Error(err, "expand redis pvc failed", "pvc", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkStorageClassExpansion 检查PVC的StorageClass是否允许扩容
+func checkStorageClassExpansion(ctx context.Context, pvc *corev1.PersistentVolumeClaim, cl client.Client) error {
+	if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+		return fmt.Errorf("pvc %s has no storage class", pvc.Name)
+	}
+	storageClass := &storagev1.StorageClass{}
+	if err := cl.Get(ctx, types.NamespacedName{Name: *pvc.Spec.StorageClassName}, storageClass); err != nil {
+		return err
+	}
+	if storageClass.AllowVolumeExpansion == nil || !*storageClass.AllowVolumeExpansion {
+		return fmt.Errorf("storage class %s does not allow volume expansion", storageClass.Name)
+	}
+	return nil
+}
+
+// recreateStatefulSet PVC模板不可修改, 以orphan方式删除statefulSet, 保留pod和PVC, 下次调谐时用新模板重建
+func recreateStatefulSet(ctx context.Context, namespace string, stateful *appsv1.StatefulSet, cl client.Client) error {
+	logger := getStatefulLog(namespace, stateful.Name)
+	err := cl.Delete(ctx, stateful, client.PropagationPolicy(metav1.DeletePropagationOrphan), client.Preconditions{UID: &stateful.UID})
+	if err != nil && !errors.IsNotFound(err) {
+		logger.Error(err, "delete redis statefulset with orphan policy failed")
+		return err
+	}
+	logger.Info("redis statefulset deleted with orphan policy, will be recreated with the new volumeClaimTemplates")
+	return nil
+}
+
+// listStatefulSetPVCs 获取statefulSet创建的PVC
+func listStatefulSetPVCs(ctx context.Context, namespace string, stateful *appsv1.StatefulSet, cl client.Client) ([]corev1.PersistentVolumeClaim, error) {
+	selector := getRedisSelectorLabels(stateful.Labels["app"], stateful.Labels["redis_setup_type"], stateful.Labels["role"])
+	pvcs, err := listRedisPVC(ctx, namespace, selector, cl)
+	if err != nil {
+		getStatefulLog(namespace, stateful.Name).Error(err, "list redis pvc failed")
+		return nil, err
+	}
+	var res []corev1.PersistentVolumeClaim
+	for _, pvc := range pvcs {
+		if _, ok := getPVCOrdinal(stateful, pvc.Name); ok {
+			res = append(res, pvc)
+		}
+	}
+	return res, nil
+}
+
+// getPVCOrdinal 解析<template>-<statefulSet>-<ordinal>格式的PVC名称
+func getPVCOrdinal(stateful *appsv1.StatefulSet, pvcName string) (int, bool) {
+	for _, template := range stateful.Spec.VolumeClaimTemplates {
+		prefix := template.Name + "-" + stateful.Name + "-"
+		if !strings.HasPrefix(pvcName, prefix) {
+			continue
+		}
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(pvcName, prefix))
+		if err == nil {
+			return ordinal, true
+		}
+	}
+	return 0, false
+}
+
+// reconcilePVCRetention 实现PVC保留策略: whenDeleted为Delete时给PVC加上CR的ownerReference由GC删除,
+// whenScaled为Delete时删除缩容后多余的PVC
+func reconcilePVCRetention(ctx context.Context, namespace string, stateful *appsv1.StatefulSet, policy *v1alpha1.PVCRetentionPolicy, ownerDef metav1.OwnerReference, cl client.Client) error {
+	if len(stateful.Spec.VolumeClaimTemplates) == 0 {
+		return nil
+	}
+	logger := getStatefulLog(namespace, stateful.Name)
+	pvcs, err := listStatefulSetPVCs(ctx, namespace, stateful, cl)
+	if err != nil {
+		return err
+	}
+	deleteWhenDeleted := policy != nil && policy.WhenDeleted == v1alpha1.PVCRetentionDelete
+	deleteWhenScaled := policy != nil && policy.WhenScaled == v1alpha1.PVCRetentionDelete
+	replicas := int32(1)
+	if stateful.Spec.Replicas != nil {
+		replicas = *stateful.Spec.Replicas
+	}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		ordinal, _ := getPVCOrdinal(stateful, pvc.Name)
+		if deleteWhenScaled && ordinal >= int(replicas) && stateful.Status.Replicas <= replicas {
+			podKey := types.NamespacedName{Namespace: namespace, Name: stateful.Name + "-" + strconv.Itoa(ordinal)}
+			if err := cl.Get(ctx, podKey, &corev1.Pod{}); errors.IsNotFound(err) {
+				logger.Info("delete redis pvc after scale down", "pvc", pvc.Name)
+				if err := cl.Delete(ctx, pvc); err != nil && !errors.IsNotFound(err) {
+					logger.Error(err, "delete redis pvc failed", "pvc", pvc.Name)
+					return err
+				}
+				continue
+			}
+		}
+
+		owned := false
+		var ownerRefs []metav1.OwnerReference
+		for _, ref := range pvc.OwnerReferences {
+			if ref.UID == ownerDef.UID {
+				owned = true
+				continue
+			}
+			ownerRefs = append(ownerRefs, ref)
+		}
+		if owned == deleteWhenDeleted {
+			continue
+		}
+		if deleteWhenDeleted {
+			ownerRefs = append(ownerRefs, metav1.OwnerReference{
+				APIVersion: ownerDef.APIVersion,
+				Kind:       ownerDef.Kind,
+				Name:       ownerDef.Name,
+				UID:        ownerDef.UID,
+			})
+		}
+		pvc.OwnerReferences = ownerRefs
+		logger.Info("update redis pvc owner reference", "pvc", pvc.Name, "deleteWhenDeleted", deleteWhenDeleted)
+		if err := cl.Update(ctx, pvc); err != nil {
+			logger.Error(err, "update redis pvc failed", "pvc", pvc.Name)
+			return err
+		}
+	}
+	return nil
+}
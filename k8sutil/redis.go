@@ -7,14 +7,19 @@ import (
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/yylover/memcached-operator/api/v1alpha1"
+	"io"
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/remotecommand"
 	"net"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-redis/redis"
 )
@@ -29,9 +34,12 @@ type RedisDetails struct {
 }
 
 // CheckRedisNodeCount 获取redis节点的个数
-func CheckRedisNodeCount(cr *v1alpha1.RedisCluster, nodeType string) int {
+func CheckRedisNodeCount(ctx context.Context, cr *v1alpha1.RedisCluster, nodeType string, cl client.Client) (int, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	clusterNodes := checkRedisCluster(cr)
+	clusterNodes, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return 0, err
+	}
 	count := len(clusterNodes)
 
 	var redisNodeType string
@@ -44,9 +52,9 @@ func CheckRedisNodeCount(cr *v1alpha1.RedisCluster, nodeType string) int {
 		redisNodeType = nodeType
 	}
 	if nodeType != "" {
-		count := 0
+		count = 0
 		for _, node := range clusterNodes {
-			if strings.Contains(node[2], redisNodeType) {
+			if len(node) > 2 && strings.Contains(node[2], redisNodeType) {
 				count++
 			}
 		}
@@ -54,23 +62,27 @@ func CheckRedisNodeCount(cr *v1alpha1.RedisCluster, nodeType string) int {
 	} else {
 		logger.Info("total number of redis nodes are", "nodes", strconv.Itoa(count))
 	}
-	return count
+	return count, nil
 }
 
 //checkRedisCluster获取redis集群的节点信息
-func checkRedisCluster(cr *v1alpha1.RedisCluster) [][]string {
-	var client *redis.Client
+func checkRedisCluster(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) ([][]string, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.ObjectMeta.Name)
-	client = configureRedisClient(cr, cr.ObjectMeta.Name+"-leader-0")
-	cmd := redis.NewStringCmd("cluster", "nodes")
-	err := client.Process(cmd)
+	redisClient, err := configureRedisClient(ctx, cr, cr.ObjectMeta.Name+"-leader-0", cl)
 	if err != nil {
+		return nil, err
+	}
+	defer redisClient.Close()
+	cmd := redis.NewStringCmd("cluster", "nodes")
+	if err := redisClient.Process(cmd); err != nil {
 		logger.Error(err, "checkRedisCluster get nodes failed")
+		return nil, err
 	}
 
 	output, err := cmd.Result()
 	if err != nil {
 		logger.Error(err, "checkRedisCluster cmd result failed")
+		return nil, err
 	}
 	logger.Info("redis cluster nodes are listed", "output", output)
 	csvOutput := csv.NewReader(strings.NewReader(output))
@@ -79,44 +91,83 @@ func checkRedisCluster(cr *v1alpha1.RedisCluster) [][]string {
 	csvOutputRecords, err := csvOutput.ReadAll()
 	if err != nil {
 		logger.Error(err, "errro parsing Node counts:", "output", output)
+		return nil, err
 	}
-	return csvOutputRecords
+	if err := translateRedisAnnouncedNodes(ctx, cr, csvOutputRecords, cl); err != nil {
+		return nil, err
+	}
+	return csvOutputRecords, nil
 }
 
 // configureRedisClient 获取pod的redisClient
-func configureRedisClient(cr *v1alpha1.RedisCluster, podName string) *redis.Client {
+func configureRedisClient(ctx context.Context, cr *v1alpha1.RedisCluster, podName string, cl client.Client) (*redis.Client, error) {
 	redisInfo := RedisDetails{
 		PodName:   podName,
 		Namespace: cr.Namespace,
 	}
-	var client *redis.Client
 	//TODO 密码
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	client = redis.NewClient(&redis.Options{
-		Addr:      getRedisServerIP(redisInfo) + ":6379",
+	redisIP, err := getRedisServerIP(ctx, redisInfo, cl)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("getRedisServerIP", "ip:", redisIP)
+	return newRedisClient(redisIP + RedisPort), nil
+}
+
+// newRedisClient 根据地址获取redisClient
+func newRedisClient(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:      addr,
 		Password:  "",
 		DB:        0,
 		TLSConfig: nil, // TODO TLSconfig
 	})
-	logger.Info("getRedisServerIP", "ip:", getRedisServerIP(redisInfo))
-	return client
 }
 
-//getRedisServerIP 获取redis service的ip
-func getRedisServerIP(redisInfo RedisDetails) string {
+// generateRedisAddr 拼接pod ip和端口
+func generateRedisAddr(podIP string, port int) string {
+	return net.JoinHostPort(podIP, strconv.Itoa(port))
+}
+
+// getRedisInfo 执行INFO命令并解析为key/value
+func getRedisInfo(redisClient *redis.Client, section string) (map[string]string, error) {
+	output, err := redisClient.Info(section).Result()
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]string{}
+	for _, line := range strings.Split(output, "\r\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info, nil
+}
+
+//getRedisServerIP 获取redis pod的ip, pod不存在或还没有分配ip时返回错误
+func getRedisServerIP(ctx context.Context, redisInfo RedisDetails, cl client.Client) (string, error) {
 	logger := generateRedisManagerLogger(redisInfo.Namespace, redisInfo.PodName)
 
-	redisPod, err := generateK8sClient().CoreV1().Pods(redisInfo.Namespace).Get(context.TODO(), redisInfo.PodName, metav1.GetOptions{})
+	redisPod := &v1.Pod{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: redisInfo.Namespace, Name: redisInfo.PodName}, redisPod)
 	if err != nil {
 		logger.Error(err, "getRedisServerIP get pod failed")
+		return "", err
 	}
 	redisIP := redisPod.Status.PodIP
+	if redisIP == "" {
+		return "", fmt.Errorf("redis pod %s has no ip yet", redisInfo.PodName)
+	}
 	if net.ParseIP(redisIP).To4() == nil { // 不是iPv4地址
 		redisIP = fmt.Sprintf("[%s]", redisIP)
 	}
 
 	logger.Info("success get ip for redis", "ip", redisPod.Status.PodIP, "redisIP:", redisIP)
-	return redisIP
+	return redisIP, nil
 }
 
 func generateRedisManagerLogger(namespace, name string) logr.Logger {
@@ -137,55 +188,129 @@ func checkRedisNodePresence(cr *v1alpha1.RedisCluster, nodeList [][]string, node
 }
 
 // createRedisReplicationCommand
-func createRedisReplicationCommand(cr *v1alpha1.RedisCluster, podLeader RedisDetails,
-	podFollower RedisDetails) []string {
+func createRedisReplicationCommand(ctx context.Context, cr *v1alpha1.RedisCluster, podLeader RedisDetails,
+	podFollower RedisDetails, leaderID string, cl client.Client) ([]string, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	cmd := []string{"redis-cli", "--cluster", "add-node"}
-	cmd = append(cmd, getRedisServerIP(podFollower)+RedisPort)
-	cmd = append(cmd, getRedisServerIP(podLeader)+RedisPort)
+	followerIP, err := getRedisServerIP(ctx, podFollower, cl)
+	if err != nil {
+		return nil, err
+	}
+	leaderIP, err := getRedisServerIP(ctx, podLeader, cl)
+	if err != nil {
+		return nil, err
+	}
+	cmd := []string{getRedisEngine(cr.Spec.Engine).CLI, "--cluster", "add-node"}
+	cmd = append(cmd, followerIP+RedisPort)
+	cmd = append(cmd, leaderIP+RedisPort)
 	cmd = append(cmd, "--cluster-slave")
+	if leaderID != "" {
+		//指定master, 否则redis-cli会挑选副本最少的master
+		cmd = append(cmd, "--cluster-master-id", leaderID)
+	}
 
 	logger.Info("redis replication create command is :", "command", cmd)
-	return cmd
+	return cmd, nil
 }
 
-// ExecuteRedisReplicationCommand 创建从集群, 不同于主集群的创建，从节点是一个一个加入的
-func ExecuteRedisReplicationCommand(cr *v1alpha1.RedisCluster) {
+// ExecuteRedisReplicationCommand 创建从集群, 不同于主集群的创建，从节点是一个一个加入的, 返回新加入的从节点个数
+func ExecuteRedisReplicationCommand(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client, config *rest.Config) (int, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	replicas := cr.Spec.Size
+	leaderReplicas := GetRedisLeaderReplicas(cr)
+	followerReplicas := GetRedisFollowerReplicas(cr)
+	if leaderReplicas == 0 {
+		return 0, nil
+	}
 
-	nodes := checkRedisCluster(cr)
-	for podCount := 0; podCount <= int(*replicas)-1; podCount++ {
+	nodes, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return 0, err
+	}
+	pairs := map[string]string{}
+	leaders, err := getRedisPodPlacements(ctx, cr, ClusterRoleLeader, cl)
+	if err != nil {
+		logger.Error(err, "get redis leader placement failed")
+		return 0, err
+	}
+	followers, err := getRedisPodPlacements(ctx, cr, ClusterRoleFollower, cl)
+	if err != nil {
+		logger.Error(err, "get redis follower placement failed")
+		return 0, err
+	}
+	if len(leaders) == int(leaderReplicas) && len(followers) == int(followerReplicas) {
+		pairs, _ = generateRedisReplicaPairs(leaders, followers, nil)
+	}
+	added := 0
+	for podCount := 0; podCount < int(followerReplicas); podCount++ {
 		podFollower := RedisDetails{
 			PodName:   cr.ObjectMeta.Name + "-follower-" + strconv.Itoa(podCount),
 			Namespace: cr.Namespace,
 		}
+		leaderName, ok := pairs[podFollower.PodName]
+		if !ok {
+			//每个leader轮流分配follower, replicasPerMaster为1时follower-N对应leader-N
+			leaderName = cr.ObjectMeta.Name + "-leader-" + strconv.Itoa(podCount%int(leaderReplicas))
+		}
 		podLeader := RedisDetails{
-			PodName:   cr.ObjectMeta.Name + "-leader-" + strconv.Itoa(podCount),
+			PodName:   leaderName,
 			Namespace: cr.Namespace,
 		}
-		podIp := getRedisServerIP(podFollower)
+		podIp, err := getRedisServerIP(ctx, podFollower, cl)
+		if err != nil {
+			return added, err
+		}
 		if !checkRedisNodePresence(cr, nodes, podIp) {
-			logger.Info("adding node to cluster : ", "node.ip", podIp, "folloer.pod", podFollower)
-			cmd := createRedisReplicationCommand(cr, podLeader, podFollower)
-			executeCommand(cr, cmd, cr.ObjectMeta.Name+"-leader-0")
+			leaderIP, err := getRedisServerIP(ctx, podLeader, cl)
+			if err != nil {
+				return added, err
+			}
+			var leaderID string
+			if node := getRedisNodeByIP(nodes, leaderIP); node != nil {
+				leaderID = node[0]
+			}
+			logger.Info("adding node to cluster : ", "node.ip", podIp, "folloer.pod", podFollower, "leader.pod", podLeader)
+			cmd, err := createRedisReplicationCommand(ctx, cr, podLeader, podFollower, leaderID, cl)
+			if err != nil {
+				return added, err
+			}
+			if err := executeCommand(ctx, cr, cmd, cr.ObjectMeta.Name+"-leader-0", cl, config); err != nil {
+				return added, err
+			}
+			added++
 		} else {
 			logger.Info("skipping adding node to cluster, already present", "follower.pod", podFollower)
 		}
 	}
+	return added, nil
 }
 
 // ExecuteRedisClusterCommand 创建redis 集群
-func ExecuteRedisClusterCommand(cr *v1alpha1.RedisCluster) {
+func ExecuteRedisClusterCommand(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client, config *rest.Config) error {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	replicas := cr.Spec.Size
-	cmd := []string{"redis-cli", "--cluster", "create"}
-	for podCount := 0; podCount <= int(*replicas)-1; podCount++ {
+	replicas := GetRedisLeaderReplicas(cr)
+	cmd := []string{getRedisEngine(cr.Spec.Engine).CLI, "--cluster", "create"}
+	var podNames []string
+	for podCount := 0; podCount < int(replicas); podCount++ {
+		podNames = append(podNames, cr.ObjectMeta.Name+"-leader-"+strconv.Itoa(podCount))
+	}
+	if cr.Spec.Topology != nil {
+		leaders, err := getRedisPodPlacements(ctx, cr, ClusterRoleLeader, cl)
+		if err != nil {
+			return err
+		}
+		if len(leaders) == int(replicas) {
+			podNames = orderRedisLeadersByZone(leaders)
+		}
+	}
+	for _, podName := range podNames {
 		pod := RedisDetails{
-			PodName:   cr.ObjectMeta.Name + "-leader-" + strconv.Itoa(podCount),
+			PodName:   podName,
 			Namespace: cr.Namespace,
 		}
-		cmd = append(cmd, getRedisServerIP(pod)+":6379")
+		podIP, err := getRedisServerIP(ctx, pod, cl)
+		if err != nil {
+			return err
+		}
+		cmd = append(cmd, podIP+":6379")
 	}
 	cmd = append(cmd, "--cluster-yes")
 
@@ -193,60 +318,74 @@ func ExecuteRedisClusterCommand(cr *v1alpha1.RedisCluster) {
 	//TODO 是否使用Tls
 	logger.Info("RedisCluster creaing cmd :", "Command", cmd)
 	//对leader0执行
-	executeCommand(cr, cmd, cr.ObjectMeta.Name+"-leader-0")
+	return executeCommand(ctx, cr, cmd, cr.ObjectMeta.Name+"-leader-0", cl, config)
 }
 
-// executeCommand 在pod中执行命令
-func executeCommand(cr *v1alpha1.RedisCluster, cmd []string, podName string) {
+// executeCommand 在pod中执行命令, 命令失败时返回的错误带上标准错误输出
+func executeCommand(ctx context.Context, cr *v1alpha1.RedisCluster, cmd []string, podName string, cl client.Client, config *rest.Config) error {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	config, err := generateK8sConfig()
-	if err != nil {
-		logger.Error(err, "cound not find pod to execute")
-		return
-	}
 
 	//获取容器id
-	targetContainner, pod := getContainerID(cr, podName)
+	targetContainner, pod, err := getContainerID(ctx, cr, podName, cl)
+	if err != nil {
+		return err
+	}
 	if targetContainner < 0 {
+		err := fmt.Errorf("could not find redis container in pod %s", podName)
 		logger.Error(err, "could not find pod to execute")
-		return
+		return err
 	}
 	logger.Info("container info ", "podName:", podName, "containerName : ", pod.Spec.Containers[targetContainner].Name)
 
-	req := generateK8sClient().CoreV1().RESTClient().Post().Resource("pods").Name(podName).Namespace(cr.Namespace).SubResource("exec")
+	var execOut bytes.Buffer
+	execErr, err := execPodCommand(cr.Namespace, podName, pod.Spec.Containers[targetContainner].Name, cmd, &execOut, config)
+	if err != nil {
+		logger.Error(err, "could not exec command", "output", execOut.String(), "Error:", execErr)
+		return fmt.Errorf("exec %q in pod %s failed: %v: %s", strings.Join(cmd, " "), podName, err, execErr)
+	}
+	logger.Info("Successfully executed the command", "output:", execOut.String())
+	return nil
+}
+
+// execPodCommand 在pod的容器中执行命令, 标准输出写入stdout, 返回标准错误
+func execPodCommand(namespace, podName, containerName string, cmd []string, stdout io.Writer, config *rest.Config) (stderr string, err error) {
+	defer func(start time.Time) {
+		observeRedisExec(cmd, start, err)
+	}(time.Now())
+	coreClient, err := corev1client.NewForConfig(config)
+	if err != nil {
+		return "", err
+	}
+
+	req := coreClient.RESTClient().Post().Resource("pods").Name(podName).Namespace(namespace).SubResource("exec")
 	req.VersionedParams(&v1.PodExecOptions{
-		Container: pod.Spec.Containers[targetContainner].Name,
+		Container: containerName,
 		Command:   cmd,
 		Stdout:    true,
 		Stderr:    true,
 	}, scheme.ParameterCodec)
 	exec, err := remotecommand.NewSPDYExecutor(config, "POST", req.URL())
 	if err != nil {
-		logger.Error(err, "failed to init excutor")
-		return
+		return "", err
 	}
 
-	var (
-		execOut bytes.Buffer
-		execErr bytes.Buffer
-	)
+	var execErr bytes.Buffer
 	err = exec.Stream(remotecommand.StreamOptions{
-		Stdout: &execOut,
+		Stdout: stdout,
 		Stderr: &execErr,
 		Tty:    false,
 	})
-	if err != nil {
-		logger.Error(err, "could not exec command", "output", execOut.String(), "Error:", execErr.String())
-	}
-	logger.Info("Successfully executed the command", "output:", execOut.String())
+	return execErr.String(), err
 }
 
-func getContainerID(cr *v1alpha1.RedisCluster, podName string) (int, *v1.Pod) {
+// getContainerID 获取pod中redis容器的下标, 找不到时返回-1
+func getContainerID(ctx context.Context, cr *v1alpha1.RedisCluster, podName string, cl client.Client) (int, *v1.Pod, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	pod, err := generateK8sClient().CoreV1().Pods(cr.Namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+	pod := &v1.Pod{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: cr.Namespace, Name: podName}, pod)
 	if err != nil {
 		logger.Error(err, "could not get pods info")
-		return -1, nil
+		return -1, nil, err
 	}
 
 	targetContainner := -1
@@ -257,53 +396,72 @@ func getContainerID(cr *v1alpha1.RedisCluster, podName string) (int, *v1.Pod) {
 			break
 		}
 	}
-	return targetContainner, pod
+	return targetContainner, pod, nil
 }
 
 // CheckRedisClusterState 检查集群状态
-func CheckRedisClusterState(cr *v1alpha1.RedisCluster) int {
+func CheckRedisClusterState(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (int, error) {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	clusterNode := checkRedisCluster(cr)
+	clusterNode, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return 0, err
+	}
 	count := 0
 	for _, node := range clusterNode {
+		if len(node) < 8 {
+			continue
+		}
 		if strings.Contains(node[2], "fail") || strings.Contains(node[7], "disconnect") {
 			count++
 		}
 	}
 
 	logger.Info("number of failed nodes in cluster", "fail node count:", count)
-	return count
+	setRedisClusterStateMetrics(cr, clusterNode, count)
+	return count, nil
 }
 
 // ExecuteFailoverOperation 执行故障切换操作
-func ExecuteFailoverOperation(cr *v1alpha1.RedisCluster) {
-	executeFailoverCmd(cr, ClusterRoleLeader)
-	executeFailoverCmd(cr, ClusterRoleFollower)
+func ExecuteFailoverOperation(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (err error) {
+	defer func() {
+		observeRedisClusterOperation(cr, redisOperationFailover, err)
+	}()
+	if err := executeFailoverCmd(ctx, cr, ClusterRoleLeader, cl); err != nil {
+		return err
+	}
+	return executeFailoverCmd(ctx, cr, ClusterRoleFollower, cl)
 }
 
-//executeFailoverCmd 执行故障切换命令
-func executeFailoverCmd(cr *v1alpha1.RedisCluster, role string) {
+//executeFailoverCmd 执行故障切换命令, reset失败时尝试flushall后重试
+func executeFailoverCmd(ctx context.Context, cr *v1alpha1.RedisCluster, role string, cl client.Client) error {
 	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
-	replicas := cr.Spec.Size
+	replicas := RedisClusterSTS{RedisStatefulSetType: role}.getReplicaCount(cr)
 	podName := cr.Name + "-" + role + "-"
 	for podCount := 0; podCount < int(*replicas); podCount++ {
 		logger.Info("executing redis failover operation", "Redis Node", podName+strconv.Itoa(podCount))
-		client := configureRedisClient(cr, podName+strconv.Itoa(podCount))
-		cmd := redis.NewStringCmd("cluster", "reset")
-		err := client.Process(cmd)
+		redisClient, err := configureRedisClient(ctx, cr, podName+strconv.Itoa(podCount), cl)
 		if err != nil {
-			logger.Error(err, "redis command failed with error")
-			flushcommand := redis.NewStringCmd("flushall")
-			err := client.Process(flushcommand)
-			if err != nil {
-				logger.Error(err, "redis flush command failed with this error")
-			}
+			return err
 		}
-
-		output, err := cmd.Result()
+		output, err := resetRedisClusterNode(redisClient)
+		redisClient.Close()
 		if err != nil {
 			logger.Error(err, "redis command failed with error:")
+			return fmt.Errorf("reset redis node %s failed: %v", podName+strconv.Itoa(podCount), err)
 		}
 		logger.Info("Redis cluster failover executed", "output", output)
 	}
+	return nil
+}
+
+// resetRedisClusterNode 执行CLUSTER RESET, 节点有数据时reset会失败, 先flushall再重试
+func resetRedisClusterNode(redisClient *redis.Client) (string, error) {
+	output, err := redisClient.ClusterResetSoft().Result()
+	if err == nil {
+		return output, nil
+	}
+	if err := redisClient.FlushAll().Err(); err != nil {
+		return "", err
+	}
+	return redisClient.ClusterResetSoft().Result()
 }
@@ -1,7 +1,13 @@
 package k8sutil
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/yylover/memcached-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 const (
@@ -9,50 +15,52 @@ const (
 	ClusterRoleFollower = "follower"
 )
 
-// CreateRedisLeader 创建leader redis设置
-func CreateRedisLeader(cr *v1alpha1.RedisCluster) error {
+// CreateRedisLeader 创建leader redis设置, restore不为空时leader从备份恢复数据
+func CreateRedisLeader(ctx context.Context, cr *v1alpha1.RedisCluster, restore *v1alpha1.RedisBackup, cl client.Client) error {
 	prop := RedisClusterSTS{
 		RedisStatefulSetType: ClusterRoleLeader,
+		Restore:              restore,
 	}
-	if cr.Spec.RedisLeader.RedisConfig != nil {
-		prop.ExternalConfig = cr.Spec.RedisLeader.RedisConfig.AdditionalRedisConfig
+	if config := getRedisClusterRoleConfig(cr, ClusterRoleLeader).RedisConfig; config != nil {
+		prop.ExternalConfig = config.AdditionalRedisConfig
 	}
-	return prop.CreateRedisClusterSetup(cr)
+	return prop.CreateRedisClusterSetup(ctx, cr, cl)
 }
 
 //CreateRedisFollower 创建RedisCluster follower
-func CreateRedisFollower(cr *v1alpha1.RedisCluster) error {
+func CreateRedisFollower(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
 	prop := RedisClusterSTS{
 		RedisStatefulSetType: ClusterRoleFollower,
 	}
-	if cr.Spec.RedisLeader.RedisConfig != nil {
-		prop.ExternalConfig = cr.Spec.RedisLeader.RedisConfig.AdditionalRedisConfig
+	if config := getRedisClusterRoleConfig(cr, ClusterRoleFollower).RedisConfig; config != nil {
+		prop.ExternalConfig = config.AdditionalRedisConfig
 	}
-	return prop.CreateRedisClusterSetup(cr)
+	return prop.CreateRedisClusterSetup(ctx, cr, cl)
 }
 
 //CreateRedisLeaderService 创建RedisCluster leader service
-func CreateRedisLeaderService(cr *v1alpha1.RedisCluster) error {
+func CreateRedisLeaderService(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
 	prop := RedisCluterService{
 		RedisServiceRole: ClusterRoleLeader,
 	}
 
-	return prop.CreateRedisClusterServcie(cr)
+	return prop.CreateRedisClusterServcie(ctx, cr, cl)
 }
 
 //CreateRedisFollowerService 创建RedisCluster follower service
-func CreateRedisFollowerService(cr *v1alpha1.RedisCluster) error {
+func CreateRedisFollowerService(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
 	prop := RedisCluterService{
 		RedisServiceRole: ClusterRoleFollower,
 	}
 
-	return prop.CreateRedisClusterServcie(cr)
+	return prop.CreateRedisClusterServcie(ctx, cr, cl)
 }
 
 //RedisClusterSTS 是调用Redis stateful函数的接口
 type RedisClusterSTS struct {
 	RedisStatefulSetType string // leader follower
 	ExternalConfig       *string
+	Restore              *v1alpha1.RedisBackup
 }
 
 // RedisCluterService 是调用Redis service的接口
@@ -60,48 +68,137 @@ type RedisCluterService struct {
 	RedisServiceRole string
 }
 
+// redisClusterRoleConfig leader或follower生效的配置, 角色上的配置优先于集群的配置
+type redisClusterRoleConfig struct {
+	RedisConfig     *v1alpha1.RedisConfig
+	PodScheduling   *v1alpha1.PodScheduling
+	Image           string
+	ImagePullPolicy corev1.PullPolicy
+	Resource        *corev1.ResourceRequirements
+	Storage         *v1alpha1.Storage
+	NodeSelector    map[string]string
+}
+
+// getRedisClusterRoleConfig 合并角色和集群的配置
+func getRedisClusterRoleConfig(cr *v1alpha1.RedisCluster, role string) redisClusterRoleConfig {
+	config := redisClusterRoleConfig{
+		RedisConfig:     cr.Spec.RedisLeader.RedisConfig,
+		PodScheduling:   cr.Spec.RedisLeader.PodScheduling,
+		Image:           cr.Spec.RedisLeader.Image,
+		ImagePullPolicy: cr.Spec.RedisLeader.ImagePullPolicy,
+		Resource:        cr.Spec.RedisLeader.Resource,
+		Storage:         cr.Spec.RedisLeader.Storage,
+		NodeSelector:    cr.Spec.RedisLeader.NodeSelector,
+	}
+	if role == ClusterRoleFollower {
+		config = redisClusterRoleConfig{
+			RedisConfig:     cr.Spec.RedisFollower.RedisConfig,
+			PodScheduling:   cr.Spec.RedisFollower.PodScheduling,
+			Image:           cr.Spec.RedisFollower.Image,
+			ImagePullPolicy: cr.Spec.RedisFollower.ImagePullPolicy,
+			Resource:        cr.Spec.RedisFollower.Resource,
+			Storage:         cr.Spec.RedisFollower.Storage,
+			NodeSelector:    cr.Spec.RedisFollower.NodeSelector,
+		}
+	}
+
+	if config.Image == "" {
+		config.Image = getRedisEngineImage(cr.Spec.Engine, cr.Spec.KubernetesConfig.Image)
+	}
+	if config.ImagePullPolicy == "" {
+		config.ImagePullPolicy = cr.Spec.KubernetesConfig.ImagePullPolicy
+	}
+	if config.Resource == nil {
+		config.Resource = cr.Spec.KubernetesConfig.Resource
+	}
+	if config.Storage == nil {
+		config.Storage = cr.Spec.Storage
+	}
+	if config.NodeSelector == nil {
+		config.NodeSelector = cr.Spec.NodeSelector
+	}
+	return config
+}
+
 //generateRedisClusterParams 生成Redis集群stateful参数
-func generateRedisClusterParams(cr *v1alpha1.RedisCluster, replicas *int32, externalConfig *string) statefulSetParameters {
+func generateRedisClusterParams(cr *v1alpha1.RedisCluster, replicas *int32, externalConfig *string, role string) statefulSetParameters {
+	config := getRedisClusterRoleConfig(cr, role)
 	res := statefulSetParameters{
 		Metadata:     cr.ObjectMeta,
 		Replicas:     replicas,
-		NodeSelector: cr.Spec.NodeSelector,
+		NodeSelector: config.NodeSelector,
+		Affinity:     generateRedisClusterAffinity(cr, role),
+		// 由operator按主从角色控制升级顺序, 见ReconcileRedisClusterUpgrade
+		UpdateStrategy: appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType},
 	}
-	if cr.Spec.Storage != nil {
-		res.PersistentVolumeClaim = cr.Spec.Storage.VolumeClaimTemplate
+	if config.Storage != nil {
+		res.PersistentVolumeClaim = config.Storage.VolumeClaimTemplate
+		res.PVCRetentionPolicy = config.Storage.PersistentVolumeClaimRetentionPolicy
 	}
 	if externalConfig != nil {
 		res.ExternalConfig = externalConfig
 	}
+	res.GeneratedConfig = generateRedisClusterConfig(cr, config)
+	res.ACLFile = isRedis7(cr.Status.RedisVersion)
+	res.WritableConfig = useRedisWritableConfig(cr.Spec.Engine)
+	//pod的subdomain在创建时确定, 始终使用headless service, 升级到7.x后域名可以直接解析
+	res.ServiceName = cr.Name + "-" + role + "-headless"
+	setPodSchedulingParams(&res, config.PodScheduling)
+	res.TopologySpreadConstraints = appendRedisZoneSpread(res.TopologySpreadConstraints, cr, role)
+	if cr.Spec.RedisExporter != nil {
+		res.EnableMetrics = true
+	}
 	return res
 }
 
 //generateRedisClusterContainerParams
-func generateRedisClusterContainerParams(cr *v1alpha1.RedisCluster) containerParameters {
+func generateRedisClusterContainerParams(cr *v1alpha1.RedisCluster, role string) containerParameters {
 	trueProperty := true
+	config := getRedisClusterRoleConfig(cr, role)
 	res := containerParameters{
 		Role:            "cluster",
-		Image:           cr.Spec.KubernetesConfig.Image,
-		ImagePullPolicy: cr.Spec.KubernetesConfig.ImagePullPolicy,
-		Resources:       cr.Spec.KubernetesConfig.Resource,
+		Image:           config.Image,
+		ImagePullPolicy: config.ImagePullPolicy,
+		Resources:       config.Resource,
+		Command:         generateRedisEngineCommand(cr.Spec.Engine),
 	}
 
-	if cr.Spec.Storage != nil {
+	if config.Storage != nil {
 		res.PersistenceEnabled = &trueProperty
 	}
+	if cr.Spec.RedisExporter != nil {
+		setRedisExporterParams(cr.Spec.RedisExporter, &res)
+	}
 
 	return res
 }
 
 // CreateRedisClusterSetup redis集群设置
-func (service RedisClusterSTS) CreateRedisClusterSetup(cr *v1alpha1.RedisCluster) error {
+func (service RedisClusterSTS) CreateRedisClusterSetup(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
 	statefulName := cr.ObjectMeta.Name + "-" + service.RedisStatefulSetType
 	logger := getStatefulLog(cr.Namespace, statefulName)
 	labels := getRedisLabels(statefulName, "cluster", service.RedisStatefulSetType, cr.ObjectMeta.GetLabels())
 	annotations := generateStatefulSetsAnots(cr.ObjectMeta)
 	objectMetaInfo := generateObjectMetaInformation(statefulName, cr.Namespace, labels, annotations)
+	params := generateRedisClusterParams(cr, service.getReplicaCount(cr), service.ExternalConfig, service.RedisStatefulSetType)
+	if service.Restore != nil {
+		records, err := getRedisClusterRestoreRecords(service.Restore)
+		if err == nil && getRedisClusterRoleConfig(cr, service.RedisStatefulSetType).Storage == nil {
+			err = fmt.Errorf("cannot restore redis cluster from backup %s without storage", service.Restore.Name)
+		}
+		if err != nil {
+			logger.Error(err, "invalid restoreFrom")
+			return err
+		}
+		keys := generateRedisRestoreKeys(statefulName+"-", records)
+		params.InitContainers = append(params.InitContainers, generateRedisRestoreContainer(cr.Spec.RestoreFrom, service.Restore, statefulName, keys))
+	} else if cr.Spec.RestoreFrom != nil {
+		if container := getRedisRestoreContainer(ctx, cr.Namespace, statefulName, cl); container != nil {
+			params.InitContainers = append(params.InitContainers, *container)
+		}
+	}
 	err := CreateOrUpdateStatefulSet(
-		cr.Namespace, objectMetaInfo, generateRedisClusterParams(cr, service.getReplicaCount(cr), service.ExternalConfig), redisClusterAsOwner(cr), generateRedisClusterContainerParams(cr))
+		ctx, cr.Namespace, objectMetaInfo, params, redisClusterAsOwner(cr), generateRedisClusterContainerParams(cr, service.RedisStatefulSetType), cl)
 	if err != nil {
 		logger.Error(err, "RedisCluster create failed")
 		return err
@@ -111,38 +208,58 @@ func (service RedisClusterSTS) CreateRedisClusterSetup(cr *v1alpha1.RedisCluster
 
 // getReplicaCount 获取集群数量配置
 func (service RedisClusterSTS) getReplicaCount(cr *v1alpha1.RedisCluster) *int32 {
-	var replicas *int32
-	if service.RedisStatefulSetType == ClusterRoleLeader {
-		replicas = cr.Spec.RedisLeader.Replicas
-	} else {
-		replicas = cr.Spec.RedisFollower.Replicas
+	replicas := GetRedisLeaderReplicas(cr)
+	if service.RedisStatefulSetType == ClusterRoleFollower {
+		replicas = GetRedisFollowerReplicas(cr)
 	}
-	if replicas == nil {
-		replicas = cr.Spec.Size
+	return &replicas
+}
+
+// GetRedisLeaderReplicas leader的个数, 未设置redisLeader.replicas时为clusterSize
+func GetRedisLeaderReplicas(cr *v1alpha1.RedisCluster) int32 {
+	if cr.Spec.RedisLeader.Replicas != nil {
+		return *cr.Spec.RedisLeader.Replicas
 	}
+	return *cr.Spec.Size
+}
 
-	return replicas
+// GetRedisFollowerReplicas follower的个数, 设置replicasPerMaster时按leader个数计算, 否则为redisFollower.replicas或clusterSize
+func GetRedisFollowerReplicas(cr *v1alpha1.RedisCluster) int32 {
+	if cr.Spec.ReplicasPerMaster != nil {
+		return GetRedisLeaderReplicas(cr) * *cr.Spec.ReplicasPerMaster
+	}
+	if cr.Spec.RedisFollower.Replicas != nil {
+		return *cr.Spec.RedisFollower.Replicas
+	}
+	return *cr.Spec.Size
 }
 
 // CreateRedisClusterServcie 生成Redis集群的Service
-func (service RedisCluterService) CreateRedisClusterServcie(cr *v1alpha1.RedisCluster) error {
+func (service RedisCluterService) CreateRedisClusterServcie(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
 	serviceName := cr.ObjectMeta.Name + "-" + service.RedisServiceRole
 	logger := serviceLogger(cr.Namespace, serviceName)
 	labels := getRedisLabels(serviceName, "cluster", service.RedisServiceRole, cr.ObjectMeta.Labels)
 	annotations := generateServiceAnots(cr.ObjectMeta)
 
 	headlessObjectMetaInfo := generateObjectMetaInformation(serviceName+"-headless", cr.Namespace, labels, annotations)
-	err := CreateOrUpdateHeadlessService(cr.Namespace, headlessObjectMetaInfo, redisClusterAsOwner(cr))
+	err := CreateOrUpdateHeadlessService(ctx, cr.Namespace, headlessObjectMetaInfo, redisClusterAsOwner(cr), cl)
 	if err != nil {
 		logger.Error(err, "RedisCluster create headless service failed", "setup.Type", service.RedisServiceRole)
 		return err
 	}
 
 	objectMetaInfo := generateObjectMetaInformation(serviceName, cr.Namespace, labels, annotations)
-	err = CreateOrUpdateService(cr.Namespace, objectMetaInfo, redisClusterAsOwner(cr))
+	err = CreateOrUpdateService(ctx, cr.Namespace, objectMetaInfo, redisClusterAsOwner(cr), cl)
 	if err != nil {
 		logger.Error(err, "RedisCluster create service failed", "setup.Type", service.RedisServiceRole)
 		return err
 	}
+
+	metricsObjectMetaInfo := generateObjectMetaInformation(serviceName+"-metrics", cr.Namespace, labels, annotations)
+	err = CreateOrUpdateRedisMetricsService(ctx, cr.Namespace, metricsObjectMetaInfo, redisClusterAsOwner(cr), cr.Spec.RedisExporter, cl)
+	if err != nil {
+		logger.Error(err, "RedisCluster create metrics service failed", "setup.Type", service.RedisServiceRole)
+		return err
+	}
 	return nil
 }
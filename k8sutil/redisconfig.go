@@ -0,0 +1,497 @@
+package k8sutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RedisConfigHashAnnotation pod模板上需要重启的参数的hash, 变化时触发滚动更新
+	RedisConfigHashAnnotation = "redis.yylover.config-hash"
+
+	generatedConfigSuffix   = "-config"
+	defaultMaxMemoryPercent = 75
+)
+
+// hotRedisConfigs 可以通过CONFIG SET在线修改的参数, 其余参数需要重启pod
+var hotRedisConfigs = map[string]bool{
+	"maxmemory":                   true,
+	"maxmemory-policy":            true,
+	"maxmemory-samples":           true,
+	"timeout":                     true,
+	"tcp-keepalive":               true,
+	"repl-timeout":                true,
+	"cluster-node-timeout":        true,
+	"lua-time-limit":              true,
+	"save":                        true,
+	"appendfsync":                 true,
+	"auto-aof-rewrite-percentage": true,
+	"auto-aof-rewrite-min-size":   true,
+	"slowlog-log-slower-than":     true,
+	"slowlog-max-len":             true,
+	"latency-monitor-threshold":   true,
+	"maxclients":                  true,
+	"hz":                          true,
+	"lazyfree-lazy-eviction":      true,
+	"lazyfree-lazy-expire":        true,
+	"lazyfree-lazy-server-del":    true,
+	"min-replicas-to-write":       true,
+	"min-replicas-max-lag":        true,
+	"repl-backlog-size":           true,
+	"repl-backlog-ttl":            true,
+	"activedefrag":                true,
+	// 开启AOF必须在线执行, 直接用appendonly yes重启会加载空的AOF文件而忽略已有的RDB
+	"appendonly":           true,
+	"aof-use-rdb-preamble": true,
+}
+
+// memoryRedisConfigs CONFIG GET返回字节数的参数, 配置文件中可以带单位
+var memoryRedisConfigs = map[string]bool{
+	"maxmemory":                 true,
+	"auto-aof-rewrite-min-size": true,
+	"repl-backlog-size":         true,
+}
+
+// redisMemoryUnits redis配置文件支持的单位, k/m/g是1000的倍数, kb/mb/gb是1024的倍数
+var redisMemoryUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// generateRedisMemoryConfig 按容器内存limit的百分比生成maxmemory, 以及maxmemory-policy
+func generateRedisMemoryConfig(config *v1alpha1.RedisConfig, resources *corev1.ResourceRequirements) map[string]string {
+	res := map[string]string{}
+	percent := int64(defaultMaxMemoryPercent)
+	if config != nil {
+		if config.MaxMemoryPercent != nil {
+			percent = int64(*config.MaxMemoryPercent)
+		}
+		if config.MaxMemoryPolicy != "" {
+			res["maxmemory-policy"] = config.MaxMemoryPolicy
+		}
+	}
+	if resources != nil {
+		if limit := resources.Limits.Memory(); !limit.IsZero() {
+			res["maxmemory"] = strconv.FormatInt(limit.Value()*percent/100, 10)
+		}
+	}
+	return res
+}
+
+// generateRedisConfig operator根据CR生成的redis参数: maxmemory、持久化方式以及按版本开启的特性
+func generateRedisConfig(config *v1alpha1.RedisConfig, persistence *v1alpha1.Persistence, resources *corev1.ResourceRequirements, version string) map[string]string {
+	res := generateRedisMemoryConfig(config, resources)
+	for name, value := range generateRedisPersistenceConfig(persistence) {
+		res[name] = value
+	}
+	for name, value := range generateRedisVersionConfig(version) {
+		res[name] = value
+	}
+	return res
+}
+
+// generateRedisSingleConfig 单例生成的redis参数, 包括engine需要的基础配置
+func generateRedisSingleConfig(cr *v1alpha1.RedisSingle) map[string]string {
+	res := generateRedisConfig(cr.Spec.RedisConfig, cr.Spec.Persistence, cr.Spec.KubernetesConfig.Resource, cr.Status.RedisVersion)
+	for name, value := range generateRedisEngineConfig(cr.Spec.Engine, false) {
+		res[name] = value
+	}
+	return res
+}
+
+// generateRedisClusterConfig 集群角色生成的redis参数, 包括engine需要的基础配置
+func generateRedisClusterConfig(cr *v1alpha1.RedisCluster, config redisClusterRoleConfig) map[string]string {
+	res := generateRedisConfig(config.RedisConfig, cr.Spec.Persistence, config.Resource, cr.Status.RedisVersion)
+	for name, value := range generateRedisEngineConfig(cr.Spec.Engine, true) {
+		res[name] = value
+	}
+	return res
+}
+
+// generateRedisPersistenceConfig 按persistence.mode生成save和appendonly等参数, 未配置时保持镜像的默认行为
+func generateRedisPersistenceConfig(persistence *v1alpha1.Persistence) map[string]string {
+	res := map[string]string{}
+	if persistence == nil {
+		return res
+	}
+	rdb := persistence.Mode == v1alpha1.PersistenceModeRDB || persistence.Mode == v1alpha1.PersistenceModeBoth
+	aof := persistence.Mode == v1alpha1.PersistenceModeAOF || persistence.Mode == v1alpha1.PersistenceModeBoth
+	if !rdb {
+		res["save"] = ""
+	} else if len(persistence.Save) > 0 {
+		res["save"] = strings.Join(persistence.Save, " ")
+	}
+	res["appendonly"] = "no"
+	if aof {
+		res["appendonly"] = "yes"
+		if persistence.AppendFsync != "" {
+			res["appendfsync"] = persistence.AppendFsync
+		}
+		if persistence.AOFUseRDBPreamble != nil {
+			res["aof-use-rdb-preamble"] = "no"
+			if *persistence.AOFUseRDBPreamble {
+				res["aof-use-rdb-preamble"] = "yes"
+			}
+		}
+	}
+	return res
+}
+
+// validateRedisPersistence RDB和AOF需要把数据写到PVC上, 没有storage时pod重建后数据丢失
+func validateRedisPersistence(persistence *v1alpha1.Persistence, storage *v1alpha1.Storage) error {
+	if persistence == nil || persistence.Mode == v1alpha1.PersistenceModeNone || storage != nil {
+		return nil
+	}
+	return fmt.Errorf("persistence mode %s requires storage", persistence.Mode)
+}
+
+// ValidateRedisSinglePersistence 检查单例的持久化配置
+func ValidateRedisSinglePersistence(cr *v1alpha1.RedisSingle) error {
+	return validateRedisPersistence(cr.Spec.Persistence, cr.Spec.Storage)
+}
+
+// ValidateRedisClusterPersistence 检查集群每个角色的持久化配置
+func ValidateRedisClusterPersistence(cr *v1alpha1.RedisCluster) error {
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		if err := validateRedisPersistence(cr.Spec.Persistence, getRedisClusterRoleConfig(cr, role).Storage); err != nil {
+			return fmt.Errorf("redis cluster %s: %v", role, err)
+		}
+	}
+	return nil
+}
+
+// getRedisConfigMapName 有operator生成的参数时使用<statefulName>-config, 否则直接使用additionalRedisConfig
+func getRedisConfigMapName(statefulName string, configMapName *string, generated map[string]string) *string {
+	if len(generated) == 0 {
+		return configMapName
+	}
+	name := statefulName + generatedConfigSuffix
+	return &name
+}
+
+// renderRedisConfig 生成的参数在前, additionalRedisConfig的内容追加在后面, 重复的参数以用户配置为准
+func renderRedisConfig(generated map[string]string, external string) string {
+	names := make([]string, 0, len(generated))
+	for name := range generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var content strings.Builder
+	for _, name := range names {
+		value := generated[name]
+		//save会追加到已有的策略上, 先清空镜像默认的策略
+		if name == "save" {
+			content.WriteString("save \"\"\n")
+			if value == "" {
+				continue
+			}
+		}
+		fmt.Fprintf(&content, "%s %s\n", name, value)
+	}
+	if external != "" {
+		content.WriteString(external)
+	}
+	return content.String()
+}
+
+// reconcileRedisGeneratedConfig 把生成的参数和additionalRedisConfig合并写入<statefulName>-config,
+// 没有生成的参数时删除该ConfigMap, 返回pod挂载的ConfigMap名称
+func reconcileRedisGeneratedConfig(ctx context.Context, namespace string, stsMeta metav1.ObjectMeta, params statefulSetParameters, ownerDef metav1.OwnerReference, cl client.Client) (*string, error) {
+	name := getRedisConfigMapName(stsMeta.Name, params.ExternalConfig, params.GeneratedConfig)
+	configMap := &corev1.ConfigMap{}
+	if len(params.GeneratedConfig) == 0 {
+		err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: stsMeta.Name + generatedConfigSuffix}, configMap)
+		//只删除operator生成的ConfigMap, 不影响用户自己同名的ConfigMap
+		if err == nil && isOwnedBy(configMap, ownerDef.UID) {
+			err = cl.Delete(ctx, configMap)
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		return name, nil
+	}
+
+	external := ""
+	if params.ExternalConfig != nil {
+		userConfigMap := &corev1.ConfigMap{}
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: *params.ExternalConfig}, userConfigMap); err != nil {
+			return nil, err
+		}
+		external = userConfigMap.Data[externalConfigFile]
+	}
+	data := map[string]string{externalConfigFile: renderRedisConfig(params.GeneratedConfig, external)}
+
+	err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: *name}, configMap)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		configMap = &corev1.ConfigMap{
+			TypeMeta:   generateTypeMeta("ConfigMap", "v1"),
+			ObjectMeta: generateObjectMetaInformation(*name, namespace, stsMeta.Labels, generateStatefulSetsAnots(stsMeta)),
+			Data:       data,
+		}
+		AddOwnerRefToObject(configMap, ownerDef)
+		return name, cl.Create(ctx, configMap)
+	}
+	if !isOwnedBy(configMap, ownerDef.UID) {
+		return nil, fmt.Errorf("configmap %s already exists and is not generated by the operator", *name)
+	}
+	if reflect.DeepEqual(configMap.Data, data) {
+		return name, nil
+	}
+	configMap.Data = data
+	return name, cl.Update(ctx, configMap)
+}
+
+// getRedisExternalConfig 读取additionalRedisConfig指向的ConfigMap并解析
+func getRedisExternalConfig(ctx context.Context, namespace string, configMapName *string, cl client.Client) (map[string]string, error) {
+	if configMapName == nil {
+		return map[string]string{}, nil
+	}
+	configMap := &corev1.ConfigMap{}
+	if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: *configMapName}, configMap); err != nil {
+		return nil, err
+	}
+	return parseRedisConfig(configMap.Data[externalConfigFile]), nil
+}
+
+// parseRedisConfig 解析redis配置文件, 多行save合并为CONFIG GET的格式, 其他重复的参数以最后一行为准
+func parseRedisConfig(content string) map[string]string {
+	config := map[string]string{}
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		args := make([]string, 0, len(fields)-1)
+		for _, field := range fields[1:] {
+			args = append(args, strings.Trim(field, `"'`))
+		}
+		value := strings.TrimSpace(strings.Join(args, " "))
+		if previous, ok := config[name]; ok && name == "save" && previous != "" && value != "" {
+			value = previous + " " + value
+		}
+		config[name] = value
+	}
+	return config
+}
+
+// normalizeRedisConfigValue 统一配置文件和CONFIG GET结果的格式再比较
+func normalizeRedisConfigValue(name, value string) string {
+	value = strings.ToLower(strings.Join(strings.Fields(value), " "))
+	if !memoryRedisConfigs[name] {
+		return value
+	}
+	for _, unit := range redisMemoryUnits {
+		if !strings.HasSuffix(value, unit.suffix) {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.TrimSuffix(value, unit.suffix), 10, 64); err == nil {
+			return strconv.FormatInt(n*unit.factor, 10)
+		}
+		break
+	}
+	return value
+}
+
+// getRedisRestartConfigs 返回需要重启才能生效的参数名, 按名称排序
+func getRedisRestartConfigs(config map[string]string) []string {
+	var names []string
+	for name := range config {
+		if !hotRedisConfigs[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateRedisConfigHash 计算需要重启的参数的hash, 在线修改的参数不影响hash
+func generateRedisConfigHash(config map[string]string) string {
+	names := getRedisRestartConfigs(config)
+	if len(names) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s %s\n", name, config[name])
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// getRedisConfigHash 读取ConfigMap计算pod模板上的配置hash
+func getRedisConfigHash(ctx context.Context, namespace string, configMapName *string, cl client.Client) (string, error) {
+	config, err := getRedisExternalConfig(ctx, namespace, configMapName, cl)
+	if err != nil {
+		return "", err
+	}
+	return generateRedisConfigHash(config), nil
+}
+
+// getReadyRedisPods 获取statefulSet中已经就绪的pod, 返回pod名到ip的映射
+func getReadyRedisPods(ctx context.Context, namespace, statefulName string, cl client.Client) (map[string]string, error) {
+	pods := &corev1.PodList{}
+	err := cl.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabels{"app": statefulName})
+	if err != nil {
+		return nil, err
+	}
+	ready := map[string]string{}
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP != "" && pod.DeletionTimestamp == nil && IsPodReady(&pod) {
+			ready[pod.Name] = pod.Status.PodIP
+		}
+	}
+	return ready, nil
+}
+
+// applyRedisConfig 对比CONFIG GET的结果, 在线修改不一致的参数并CONFIG REWRITE写回配置文件
+func applyRedisConfig(ip string, config map[string]string) ([]string, error) {
+	redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+	defer redisClient.Close()
+
+	var changed []string
+	for name, value := range config {
+		if !hotRedisConfigs[name] {
+			continue
+		}
+		current, err := getRedisConfig(redisClient, name)
+		if err != nil {
+			return changed, err
+		}
+		if normalizeRedisConfigValue(name, current) == normalizeRedisConfigValue(name, value) {
+			continue
+		}
+		if err := redisClient.ConfigSet(name, value).Err(); err != nil {
+			return changed, fmt.Errorf("config set %s: %v", name, err)
+		}
+		changed = append(changed, name)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(changed)
+	if err := redisClient.ConfigRewrite().Err(); err != nil {
+		return changed, fmt.Errorf("config rewrite: %v", err)
+	}
+	return changed, nil
+}
+
+// reconcileRedisConfig 在线参数在每个就绪的pod上执行CONFIG SET, 需要重启的参数由pod模板上的hash触发滚动更新,
+// 返回更新后的状态
+func reconcileRedisConfig(ctx context.Context, namespace, statefulName string, configMapName *string, status *v1alpha1.RedisConfigStatus, cl client.Client) (*v1alpha1.RedisConfigStatus, error) {
+	logger := generateRedisManagerLogger(namespace, statefulName)
+	config, err := getRedisExternalConfig(ctx, namespace, configMapName, cl)
+	if err != nil {
+		logger.Error(err, "get redis external config failed")
+		return status, err
+	}
+	pods, err := getReadyRedisPods(ctx, namespace, statefulName, cl)
+	if err != nil {
+		logger.Error(err, "list redis pods failed")
+		return status, err
+	}
+
+	onlineParameters := map[string]bool{}
+	for podName, ip := range pods {
+		changed, err := applyRedisConfig(ip, config)
+		for _, name := range changed {
+			onlineParameters[name] = true
+		}
+		if err != nil {
+			logger.Error(err, "apply redis config failed", "pod", podName)
+			return status, err
+		}
+		if len(changed) > 0 {
+			logger.Info("redis config applied online", "pod", podName, "parameters", changed)
+		}
+	}
+
+	res := &v1alpha1.RedisConfigStatus{}
+	if status != nil {
+		res = status.DeepCopy()
+	}
+	now := metav1.Now()
+	hash := generateRedisConfigHash(config)
+	if status != nil && status.RestartHash != hash {
+		logger.Info("redis config requires restart, rolling pods", "parameters", getRedisRestartConfigs(config))
+		res.Path = v1alpha1.RedisConfigPathRollout
+		res.OnlineParameters = nil
+		res.LastUpdateTime = &now
+	} else if len(onlineParameters) > 0 {
+		res.Path = v1alpha1.RedisConfigPathOnline
+		res.OnlineParameters = nil
+		for name := range onlineParameters {
+			res.OnlineParameters = append(res.OnlineParameters, name)
+		}
+		sort.Strings(res.OnlineParameters)
+		res.LastUpdateTime = &now
+	}
+	res.RestartHash = hash
+	res.RestartParameters = getRedisRestartConfigs(config)
+	return res, nil
+}
+
+// ReconcileRedisSingleConfig 在线应用单例的配置变更, 结果写入status
+func ReconcileRedisSingleConfig(ctx context.Context, cr *v1alpha1.RedisSingle, cl client.Client) error {
+	var configMapName *string
+	if cr.Spec.RedisConfig != nil {
+		configMapName = cr.Spec.RedisConfig.AdditionalRedisConfig
+	}
+	configMapName = getRedisConfigMapName(cr.Name, configMapName, generateRedisSingleConfig(cr))
+	status, err := reconcileRedisConfig(ctx, cr.Namespace, cr.Name, configMapName, cr.Status.Config, cl)
+	cr.Status.Config = status
+	return err
+}
+
+// ReconcileRedisReplicationConfig 在线应用主从复制的配置变更, 结果写入status
+func ReconcileRedisReplicationConfig(ctx context.Context, cr *v1alpha1.RedisReplication, cl client.Client) error {
+	var configMapName *string
+	if cr.Spec.RedisConfig != nil {
+		configMapName = cr.Spec.RedisConfig.AdditionalRedisConfig
+	}
+	configMapName = getRedisConfigMapName(cr.Name, configMapName, generateRedisMemoryConfig(cr.Spec.RedisConfig, cr.Spec.KubernetesConfig.Resource))
+	status, err := reconcileRedisConfig(ctx, cr.Namespace, cr.Name, configMapName, cr.Status.Config, cl)
+	cr.Status.Config = status
+	return err
+}
+
+// ReconcileRedisClusterConfig 按角色在线应用集群的配置变更, 结果写入status
+func ReconcileRedisClusterConfig(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		var configMapName *string
+		config := getRedisClusterRoleConfig(cr, role)
+		if config.RedisConfig != nil {
+			configMapName = config.RedisConfig.AdditionalRedisConfig
+		}
+		configMapName = getRedisConfigMapName(cr.Name+"-"+role, configMapName, generateRedisClusterConfig(cr, config))
+		current := &cr.Status.LeaderConfig
+		if role == ClusterRoleFollower {
+			current = &cr.Status.FollowerConfig
+		}
+		status, err := reconcileRedisConfig(ctx, cr.Namespace, cr.Name+"-"+role, configMapName, *current, cl)
+		*current = status
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package k8sutil
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RedisRoleLabel 标记主从复制中pod的角色, master service通过它选中master
+	RedisRoleLabel   = "redis_role"
+	RedisRoleMaster  = "master"
+	RedisRoleReplica = "slave"
+)
+
+// CreateRedisReplication 创建主从复制的statefulSet
+func CreateRedisReplication(ctx context.Context, cr *v1alpha1.RedisReplication, cl client.Client) error {
+	logger := getStatefulLog(cr.Namespace, cr.Name)
+	labels := getRedisLabels(cr.Name, "replication", "replication", cr.ObjectMeta.GetLabels())
+	annotations := generateStatefulSetsAnots(cr.ObjectMeta)
+	objectMetaInfo := generateObjectMetaInformation(cr.ObjectMeta.Name, cr.Namespace, labels, annotations)
+	err := CreateOrUpdateStatefulSet(ctx, cr.Namespace, objectMetaInfo, generateRedisReplicationParams(cr), redisReplicationAsOwner(cr), generateRedisReplicationContainerParams(cr), cl)
+	if err != nil {
+		logger.Error(err, "cannot create replication Redis")
+		return err
+	}
+	return nil
+}
+
+// CreateRedisReplicationService 创建主从复制的service, <name>-master 始终指向当前的master
+func CreateRedisReplicationService(ctx context.Context, cr *v1alpha1.RedisReplication, cl client.Client) error {
+	logger := serviceLogger(cr.Namespace, cr.Name)
+	labels := getRedisLabels(cr.Name, "replication", "replication", cr.Labels)
+	annotations := generateServiceAnots(cr.ObjectMeta)
+
+	headlessObjectMetaInfo := generateObjectMetaInformation(cr.Name+"-headless", cr.Namespace, labels, annotations)
+	if err := CreateOrUpdateHeadlessService(ctx, cr.Namespace, headlessObjectMetaInfo, redisReplicationAsOwner(cr), cl); err != nil {
+		logger.Error(err, "cannot create replication headless service for redis")
+		return err
+	}
+
+	objectMetaInfo := generateObjectMetaInformation(cr.Name, cr.Namespace, labels, annotations)
+	if err := CreateOrUpdateService(ctx, cr.Namespace, objectMetaInfo, redisReplicationAsOwner(cr), cl); err != nil {
+		logger.Error(err, "cannot create replication service for redis")
+		return err
+	}
+
+	masterSelector := map[string]string{RedisRoleLabel: RedisRoleMaster}
+	for k, v := range labels {
+		masterSelector[k] = v
+	}
+	masterObjectMetaInfo := generateObjectMetaInformation(cr.Name+"-master", cr.Namespace, labels, annotations)
+	if err := CreateOrUpdateSelectorService(ctx, cr.Namespace, masterObjectMetaInfo, masterSelector, redisReplicationAsOwner(cr), cl); err != nil {
+		logger.Error(err, "cannot create replication master service for redis")
+		return err
+	}
+	return nil
+}
+
+// generateRedisReplicationParams 生成主从复制statefulSet参数
+func generateRedisReplicationParams(cr *v1alpha1.RedisReplication) statefulSetParameters {
+	res := statefulSetParameters{
+		Metadata:     cr.ObjectMeta,
+		Replicas:     cr.Spec.Size,
+		NodeSelector: cr.Spec.NodeSelector,
+	}
+	if cr.Spec.Storage != nil {
+		res.PersistentVolumeClaim = cr.Spec.Storage.VolumeClaimTemplate
+		res.PVCRetentionPolicy = cr.Spec.Storage.PersistentVolumeClaimRetentionPolicy
+	}
+	if cr.Spec.RedisConfig != nil {
+		res.ExternalConfig = cr.Spec.RedisConfig.AdditionalRedisConfig
+	}
+	res.GeneratedConfig = generateRedisMemoryConfig(cr.Spec.RedisConfig, cr.Spec.KubernetesConfig.Resource)
+	return res
+}
+
+// generateRedisReplicationContainerParams 生成主从复制容器信息
+func generateRedisReplicationContainerParams(cr *v1alpha1.RedisReplication) containerParameters {
+	trueProperty := true
+	res := containerParameters{
+		Role:            "replication",
+		Image:           getRedisEngineImage(v1alpha1.RedisEngineRedis, cr.Spec.KubernetesConfig.Image),
+		ImagePullPolicy: cr.Spec.KubernetesConfig.ImagePullPolicy,
+		Resources:       cr.Spec.KubernetesConfig.Resource,
+	}
+	if cr.Spec.Storage != nil {
+		res.PersistenceEnabled = &trueProperty
+	}
+	return res
+}
+
+// redisReplicationNode 主从复制中一个pod的复制状态
+type redisReplicationNode struct {
+	PodName        string
+	IP             string
+	Role           string
+	MasterHost     string
+	ConnectedSlave int
+	ReplOffset     int64
+	Labeled        bool
+}
+
+// getRedisReplicationNodes 获取所有就绪pod的复制状态, 按pod名排序
+func getRedisReplicationNodes(ctx context.Context, cr *v1alpha1.RedisReplication, cl client.Client) ([]redisReplicationNode, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	pods := &corev1.PodList{}
+	err := cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels(getRedisLabels(cr.Name, "replication", "replication", cr.Labels)))
+	if err != nil {
+		logger.Error(err, "list redis replication pods failed")
+		return nil, err
+	}
+
+	var nodes []redisReplicationNode
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		redisClient := newRedisClient(generateRedisAddr(pod.Status.PodIP, redisPort))
+		info, err := getRedisInfo(redisClient, "replication")
+		redisClient.Close()
+		if err != nil {
+			logger.Error(err, "get redis replication info failed", "pod", pod.Name)
+			continue
+		}
+		connectedSlaves, _ := strconv.Atoi(info["connected_slaves"])
+		offset, _ := strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+		nodes = append(nodes, redisReplicationNode{
+			PodName:        pod.Name,
+			IP:             pod.Status.PodIP,
+			Role:           info["role"],
+			MasterHost:     info["master_host"],
+			ConnectedSlave: connectedSlaves,
+			ReplOffset:     offset,
+			Labeled:        pod.Labels[RedisRoleLabel] == RedisRoleMaster,
+		})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].PodName < nodes[j].PodName
+	})
+	return nodes, nil
+}
+
+// selectRedisReplicationMaster 选择master: 优先选择带有slave的master(sentinel切换后的新master),
+// 其次是已经打了master标签的pod, 全新部署时选择第一个pod;
+// master丢失且允许切换时提升复制偏移量最大的slave, 否则返回nil等待sentinel切换
+func selectRedisReplicationMaster(nodes []redisReplicationNode, allowPromotion bool) *redisReplicationNode {
+	var master, candidate *redisReplicationNode
+	hasReplica := false
+	for i := range nodes {
+		node := &nodes[i]
+		if node.Role != "master" {
+			hasReplica = true
+			if candidate == nil || node.ReplOffset > candidate.ReplOffset {
+				candidate = node
+			}
+			continue
+		}
+		if master == nil || node.ConnectedSlave > master.ConnectedSlave ||
+			(node.ConnectedSlave == master.ConnectedSlave && node.Labeled && !master.Labeled) {
+			master = node
+		}
+	}
+	if master != nil && (master.ConnectedSlave > 0 || master.Labeled) {
+		return master
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+	if !hasReplica {
+		return &nodes[0]
+	}
+	if allowPromotion {
+		return candidate
+	}
+	return nil
+}
+
+// ReconcileRedisReplication 配置主从复制关系, 并把master标签打到当前master上;
+// 有sentinel监控时allowPromotion为false, 故障切换交给sentinel
+func ReconcileRedisReplication(ctx context.Context, cr *v1alpha1.RedisReplication, allowPromotion bool, cl client.Client) (string, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	nodes, err := getRedisReplicationNodes(ctx, cr, cl)
+	if err != nil {
+		return "", err
+	}
+	master := selectRedisReplicationMaster(nodes, allowPromotion)
+	if master == nil {
+		logger.Info("redis replication master not available, waiting for failover")
+		return "", nil
+	}
+
+	if master.Role != "master" {
+		logger.Info("promote redis replica to master", "pod", master.PodName)
+		redisClient := newRedisClient(generateRedisAddr(master.IP, redisPort))
+		err := redisClient.SlaveOf("NO", "ONE").Err()
+		redisClient.Close()
+		if err != nil {
+			logger.Error(err, "redis slaveof no one failed", "pod", master.PodName)
+			return "", err
+		}
+	}
+
+	for _, node := range nodes {
+		if node.PodName == master.PodName || (node.Role == "slave" && node.MasterHost == master.IP) {
+			continue
+		}
+		logger.Info("configure redis replica", "pod", node.PodName, "master", master.PodName)
+		redisClient := newRedisClient(generateRedisAddr(node.IP, redisPort))
+		err := redisClient.SlaveOf(master.IP, strconv.Itoa(redisPort)).Err()
+		redisClient.Close()
+		if err != nil {
+			logger.Error(err, "redis slaveof failed", "pod", node.PodName)
+			return "", err
+		}
+	}
+
+	if err := SetRedisReplicationMaster(ctx, cr, master.PodName, cl); err != nil {
+		return "", err
+	}
+	return master.PodName, nil
+}
+
+// SetRedisReplicationMaster 更新pod的角色标签, 让master service指向masterPod
+func SetRedisReplicationMaster(ctx context.Context, cr *v1alpha1.RedisReplication, masterPod string, cl client.Client) error {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	pods := &corev1.PodList{}
+	err := cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels(getRedisLabels(cr.Name, "replication", "replication", cr.Labels)))
+	if err != nil {
+		logger.Error(err, "list redis replication pods failed")
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		role := RedisRoleReplica
+		if pod.Name == masterPod {
+			role = RedisRoleMaster
+		}
+		if pod.Labels[RedisRoleLabel] == role {
+			continue
+		}
+		logger.Info("update redis pod role label", "pod", pod.Name, "role", role)
+		patch := client.MergeFrom(pod.DeepCopy())
+		pod.Labels[RedisRoleLabel] = role
+		if err := cl.Patch(ctx, pod, patch); err != nil {
+			logger.Error(err, "patch redis pod role label failed", "pod", pod.Name)
+			return err
+		}
+	}
+	return nil
+}
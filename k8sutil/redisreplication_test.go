@@ -0,0 +1,90 @@
+package k8sutil
+
+import (
+	"testing"
+)
+
+func TestSelectRedisReplicationMaster(t *testing.T) {
+	tests := []struct {
+		name           string
+		nodes          []redisReplicationNode
+		allowPromotion bool
+		want           string
+	}{
+		{
+			name: "labeled master with replicas",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-0", Role: "master", ConnectedSlave: 2, Labeled: true},
+				{PodName: "redis-1", Role: "slave", ReplOffset: 100},
+				{PodName: "redis-2", Role: "slave", ReplOffset: 90},
+			},
+			want: "redis-0",
+		},
+		{
+			name: "sentinel promoted master wins over the stale labeled master",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-0", Role: "master", Labeled: true},
+				{PodName: "redis-1", Role: "master", ConnectedSlave: 1},
+				{PodName: "redis-2", Role: "slave", ReplOffset: 90},
+			},
+			want: "redis-1",
+		},
+		{
+			name: "labeled master restarted without replicas",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-0", Role: "master"},
+				{PodName: "redis-1", Role: "master", Labeled: true},
+				{PodName: "redis-2", Role: "master"},
+			},
+			want: "redis-1",
+		},
+		{
+			name: "fresh deployment picks the first pod",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-0", Role: "master"},
+				{PodName: "redis-1", Role: "master"},
+			},
+			want: "redis-0",
+		},
+		{
+			name: "no master and promotion disallowed waits for sentinel",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-1", Role: "slave", ReplOffset: 100},
+				{PodName: "redis-2", Role: "slave", ReplOffset: 120},
+			},
+			want: "",
+		},
+		{
+			name: "no master and promotion allowed promotes the largest offset",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-1", Role: "slave", ReplOffset: 100},
+				{PodName: "redis-2", Role: "slave", ReplOffset: 120},
+			},
+			allowPromotion: true,
+			want:           "redis-2",
+		},
+		{
+			name: "unlabeled master without replicas is not trusted",
+			nodes: []redisReplicationNode{
+				{PodName: "redis-0", Role: "master"},
+				{PodName: "redis-1", Role: "slave", ReplOffset: 100},
+			},
+			want: "",
+		},
+		{
+			name: "no ready pods",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if master := selectRedisReplicationMaster(tt.nodes, tt.allowPromotion); master != nil {
+				got = master.PodName
+			}
+			if got != tt.want {
+				t.Errorf("selectRedisReplicationMaster() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultSentinelMasterGroup = "mymaster"
+	sentinelConfigPath         = "/sentinel"
+)
+
+// CreateRedisSentinel 创建sentinel的statefulSet
+func CreateRedisSentinel(ctx context.Context, cr *v1alpha1.RedisSentinel, cl client.Client) error {
+	logger := getStatefulLog(cr.Namespace, cr.Name)
+	labels := getRedisLabels(cr.Name, "sentinel", "sentinel", cr.ObjectMeta.GetLabels())
+	annotations := generateStatefulSetsAnots(cr.ObjectMeta)
+	objectMetaInfo := generateObjectMetaInformation(cr.ObjectMeta.Name, cr.Namespace, labels, annotations)
+	err := CreateOrUpdateStatefulSet(ctx, cr.Namespace, objectMetaInfo, generateRedisSentinelParams(cr), redisSentinelAsOwner(cr), generateRedisSentinelContainerParams(cr), cl)
+	if err != nil {
+		logger.Error(err, "cannot create redis sentinel")
+		return err
+	}
+	return nil
+}
+
+// CreateRedisSentinelService 创建sentinel的service
+func CreateRedisSentinelService(ctx context.Context, cr *v1alpha1.RedisSentinel, cl client.Client) error {
+	logger := serviceLogger(cr.Namespace, cr.Name)
+	labels := getRedisLabels(cr.Name, "sentinel", "sentinel", cr.Labels)
+	annotations := generateServiceAnots(cr.ObjectMeta)
+
+	headlessObjectMetaInfo := generateObjectMetaInformation(cr.Name+"-headless", cr.Namespace, labels, annotations)
+	if err := createOrUpdateService(ctx, cr.Namespace, generateHeadlessServiceDef(headlessObjectMetaInfo, redisSentinelAsOwner(cr), sentinelPort), cl); err != nil {
+		logger.Error(err, "cannot create sentinel headless service")
+		return err
+	}
+
+	objectMetaInfo := generateObjectMetaInformation(cr.Name, cr.Namespace, labels, annotations)
+	if err := createOrUpdateService(ctx, cr.Namespace, generateServiceDef(objectMetaInfo, labels, redisSentinelAsOwner(cr), sentinelPort), cl); err != nil {
+		logger.Error(err, "cannot create sentinel service")
+		return err
+	}
+	return nil
+}
+
+// generateRedisSentinelParams 生成sentinel statefulSet参数, sentinel需要可写的配置文件
+func generateRedisSentinelParams(cr *v1alpha1.RedisSentinel) statefulSetParameters {
+	return statefulSetParameters{
+		Metadata:     cr.ObjectMeta,
+		Replicas:     cr.Spec.Size,
+		NodeSelector: cr.Spec.NodeSelector,
+		AdditionalVolumes: []corev1.Volume{
+			{
+				Name: "sentinel-config",
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		},
+	}
+}
+
+// generateRedisSentinelContainerParams 生成sentinel容器信息, 监控配置由operator通过SENTINEL MONITOR下发
+func generateRedisSentinelContainerParams(cr *v1alpha1.RedisSentinel) containerParameters {
+	script := fmt.Sprintf("[ -f %[1]s/sentinel.conf ] || printf 'port %[2]d\\ndir /tmp\\n' > %[1]s/sentinel.conf; exec redis-sentinel %[1]s/sentinel.conf",
+		sentinelConfigPath, sentinelPort)
+	return containerParameters{
+		Role:            "sentinel",
+		Image:           getRedisEngineImage(v1alpha1.RedisEngineRedis, cr.Spec.KubernetesConfig.Image),
+		ImagePullPolicy: cr.Spec.KubernetesConfig.ImagePullPolicy,
+		Resources:       cr.Spec.KubernetesConfig.Resource,
+		Command:         []string{"sh", "-c", script},
+		AdditionalMountPath: []corev1.VolumeMount{
+			{
+				Name:      "sentinel-config",
+				MountPath: sentinelConfigPath,
+			},
+		},
+	}
+}
+
+// getSentinelMasterGroup 获取sentinel监控的组名
+func getSentinelMasterGroup(cr *v1alpha1.RedisSentinel) string {
+	if cr.Spec.RedisSentinelConfig.MasterGroupName != "" {
+		return cr.Spec.RedisSentinelConfig.MasterGroupName
+	}
+	return defaultSentinelMasterGroup
+}
+
+// getSentinelQuorum 获取quorum, 默认sentinel数量过半
+func getSentinelQuorum(cr *v1alpha1.RedisSentinel) int32 {
+	if cr.Spec.RedisSentinelConfig.Quorum != nil {
+		return *cr.Spec.RedisSentinelConfig.Quorum
+	}
+	return *cr.Spec.Size/2 + 1
+}
+
+// monitorRedisMaster 在sentinel上执行SENTINEL MONITOR并下发切换参数
+func monitorRedisMaster(cr *v1alpha1.RedisSentinel, redisClient *redis.Client, masterIP string) error {
+	group := getSentinelMasterGroup(cr)
+	err := redisClient.Process(redis.NewStatusCmd("sentinel", "monitor", group, masterIP, strconv.Itoa(redisPort), getSentinelQuorum(cr)))
+	if err != nil {
+		return err
+	}
+
+	config := cr.Spec.RedisSentinelConfig
+	args := []interface{}{"sentinel", "set", group}
+	if config.DownAfterMilliseconds != nil {
+		args = append(args, "down-after-milliseconds", *config.DownAfterMilliseconds)
+	}
+	if config.FailoverTimeout != nil {
+		args = append(args, "failover-timeout", *config.FailoverTimeout)
+	}
+	if config.ParallelSyncs != nil {
+		args = append(args, "parallel-syncs", *config.ParallelSyncs)
+	}
+	if len(args) == 3 {
+		return nil
+	}
+	return redisClient.Process(redis.NewStatusCmd(args...))
+}
+
+// getSentinelMasterAddr 查询sentinel当前的master地址, 未监控时返回空
+func getSentinelMasterAddr(cr *v1alpha1.RedisSentinel, redisClient *redis.Client) (string, error) {
+	cmd := redis.NewStringSliceCmd("sentinel", "get-master-addr-by-name", getSentinelMasterGroup(cr))
+	if err := redisClient.Process(cmd); err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+		return "", err
+	}
+	addr := cmd.Val()
+	if len(addr) == 0 {
+		return "", nil
+	}
+	return addr[0], nil
+}
+
+// ReconcileRedisSentinel 确保每个sentinel都监控主从组, 并让master service指向sentinel选出的master
+func ReconcileRedisSentinel(ctx context.Context, cr *v1alpha1.RedisSentinel, replication *v1alpha1.RedisReplication, cl client.Client) (string, string, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	nodes, err := getRedisReplicationNodes(ctx, replication, cl)
+	if err != nil {
+		return "", "", err
+	}
+	// 不提升slave, 只识别已经健康的master, 避免和sentinel的故障切换冲突
+	healthyMaster := selectRedisReplicationMaster(nodes, false)
+	podByIP := map[string]string{}
+	for _, node := range nodes {
+		podByIP[node.IP] = node.PodName
+	}
+
+	pods := &corev1.PodList{}
+	err = cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels(getRedisLabels(cr.Name, "sentinel", "sentinel", cr.Labels)))
+	if err != nil {
+		logger.Error(err, "list redis sentinel pods failed")
+		return "", "", err
+	}
+
+	votes := map[string]int{}
+	sentinels := 0
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		sentinels++
+		redisClient := newRedisClient(generateRedisAddr(pod.Status.PodIP, sentinelPort))
+		masterIP, err := getSentinelMasterAddr(cr, redisClient)
+		if err != nil {
+			logger.Error(err, "sentinel get master addr failed", "pod", pod.Name)
+			redisClient.Close()
+			continue
+		}
+
+		// 所有redis pod重建后ip都变了, sentinel记录的master已经不存在
+		_, known := podByIP[masterIP]
+		if masterIP != "" && !known && healthyMaster != nil && healthyMaster.ConnectedSlave > 0 {
+			logger.Info("sentinel master is stale, remove it", "pod", pod.Name, "master", masterIP)
+			if err := redisClient.Process(redis.NewStatusCmd("sentinel", "remove", getSentinelMasterGroup(cr))); err != nil {
+				logger.Error(err, "sentinel remove failed", "pod", pod.Name)
+			}
+			masterIP = ""
+		}
+		if masterIP == "" && healthyMaster != nil {
+			logger.Info("sentinel monitor redis master", "pod", pod.Name, "master", healthyMaster.PodName)
+			if err := monitorRedisMaster(cr, redisClient, healthyMaster.IP); err != nil {
+				logger.Error(err, "sentinel monitor failed", "pod", pod.Name)
+				redisClient.Close()
+				return "", "", err
+			}
+			masterIP = healthyMaster.IP
+		}
+		redisClient.Close()
+		if masterIP != "" {
+			votes[masterIP]++
+		}
+	}
+
+	masterIP := selectSentinelMaster(votes, sentinels)
+	if masterIP == "" {
+		logger.Info("sentinels do not agree on the master, keep the current one", "votes", votes)
+		return cr.Status.MasterNode, cr.Status.MasterAddress, nil
+	}
+	masterPod, ok := podByIP[masterIP]
+	if !ok {
+		logger.Info("sentinel master is not ready", "master", masterIP)
+		return "", masterIP, nil
+	}
+	if err := SetRedisReplicationMaster(ctx, replication, masterPod, cl); err != nil {
+		return "", "", err
+	}
+	return masterPod, masterIP, nil
+}
+
+// selectSentinelMaster 超过半数的sentinel认可的master, 分区或者sentinel个数为偶数时可能没有, 返回空
+func selectSentinelMaster(votes map[string]int, sentinels int) string {
+	for ip, count := range votes {
+		if count > sentinels/2 {
+			return ip
+		}
+	}
+	return ""
+}
@@ -0,0 +1,28 @@
+package k8sutil
+
+import (
+	"testing"
+)
+
+func TestSelectSentinelMaster(t *testing.T) {
+	tests := []struct {
+		name      string
+		votes     map[string]int
+		sentinels int
+		want      string
+	}{
+		{name: "all sentinels agree", votes: map[string]int{"10.0.0.1": 3}, sentinels: 3, want: "10.0.0.1"},
+		{name: "majority", votes: map[string]int{"10.0.0.1": 2, "10.0.0.2": 1}, sentinels: 3, want: "10.0.0.1"},
+		{name: "tie between two sentinels", votes: map[string]int{"10.0.0.1": 1, "10.0.0.2": 1}, sentinels: 2},
+		{name: "half is not a majority", votes: map[string]int{"10.0.0.1": 2, "10.0.0.2": 2}, sentinels: 4},
+		{name: "unreachable sentinels count against quorum", votes: map[string]int{"10.0.0.1": 1}, sentinels: 3},
+		{name: "no votes", sentinels: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectSentinelMaster(tt.votes, tt.sentinels); got != tt.want {
+				t.Errorf("selectSentinelMaster() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,37 @@
 package k8sutil
 
 import (
+	"context"
+	"fmt"
+
 	testopv1alpha1 "github.com/yylover/memcached-operator/api/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-//CreateSingleRedis will create a singleRedis setup
-func CreateSingleRedis(cr *testopv1alpha1.RedisSingle) error {
+//CreateSingleRedis will create a singleRedis setup, restore不为空时先从备份恢复数据
+func CreateSingleRedis(ctx context.Context, cr *testopv1alpha1.RedisSingle, restore *testopv1alpha1.RedisBackup, cl client.Client) error {
 	logger := getStatefulLog(cr.Namespace, cr.Name)
 	logger.Info("CreateSingleRedis begin")
 
 	labes := getRedisLabels(cr.Name, "standalone", "standalone", cr.ObjectMeta.GetLabels())
 	annotations := generateStatefulSetsAnots(cr.ObjectMeta)
 	objectMetaInfo := generateObjectMetaInformation(cr.ObjectMeta.Name, cr.Namespace, labes, annotations)
+	params := generateRedisStandaloneParams(cr)
+	if restore != nil {
+		if cr.Spec.Storage == nil || len(restore.Status.Records) != 1 {
+			err := fmt.Errorf("cannot restore redis single from backup %s, storage is required and the backup must have exactly one record", restore.Name)
+			logger.Error(err, "invalid restoreFrom")
+			return err
+		}
+		keys := generateRedisRestoreKeys(cr.Name+"-", restore.Status.Records)
+		params.InitContainers = append(params.InitContainers, generateRedisRestoreContainer(cr.Spec.RestoreFrom, restore, cr.Name, keys))
+	} else if cr.Spec.RestoreFrom != nil {
+		if container := getRedisRestoreContainer(ctx, cr.Namespace, cr.Name, cl); container != nil {
+			params.InitContainers = append(params.InitContainers, *container)
+		}
+	}
 	//获取statefulSet
-	err := CreateOrUpdateStatefulSet(cr.Namespace, objectMetaInfo, generateRedisStandaloneParams(cr), redisAsOwner(cr), generateRedisStandaloneContainerParams(cr))
+	err := CreateOrUpdateStatefulSet(ctx, cr.Namespace, objectMetaInfo, params, redisAsOwner(cr), generateRedisStandaloneContainerParams(cr), cl)
 	if err != nil {
 		logger.Error(err, "cannot create single Redis")
 		return err
@@ -22,23 +40,31 @@ func CreateSingleRedis(cr *testopv1alpha1.RedisSingle) error {
 }
 
 // CreateSingleRedisService创建redis单例的service
-func CreateSingleRedisService(cr *testopv1alpha1.RedisSingle) error {
+func CreateSingleRedisService(ctx context.Context, cr *testopv1alpha1.RedisSingle, cl client.Client) error {
 	logger := serviceLogger(cr.Namespace, cr.Name)
 	labels := getRedisLabels(cr.Name, "standalone", "standalone", cr.Labels)
 	annotations := generateServiceAnots(cr.ObjectMeta)
-	//TODO Exporter
 
 	headlessObjectMetaInfo := generateObjectMetaInformation(cr.Name+"-headless", cr.Namespace, labels, annotations)
-	err := CreateOrUpdateHeadlessService(cr.Namespace, headlessObjectMetaInfo, redisAsOwner(cr))
+	err := CreateOrUpdateHeadlessService(ctx, cr.Namespace, headlessObjectMetaInfo, redisAsOwner(cr), cl)
 	if err != nil {
 		logger.Error(err, "cannot create standalone headless service for redis")
 		return err
 	}
 
+	//spec.service只作用于对外访问的service, headless service保持不变
 	objectMetaInfo := generateObjectMetaInformation(cr.Name, cr.Namespace, labels, annotations)
-	err = CreateOrUpdateService(cr.Namespace, objectMetaInfo, redisAsOwner(cr))
+	err = CreateOrUpdateExternalService(ctx, cr.Namespace, objectMetaInfo, labels, cr.Spec.Service, redisAsOwner(cr), cl)
 	if err != nil {
 		logger.Error(err, "cannot create standalone service for redis")
+		return err
+	}
+
+	metricsObjectMetaInfo := generateObjectMetaInformation(cr.Name+"-metrics", cr.Namespace, labels, annotations)
+	err = CreateOrUpdateRedisMetricsService(ctx, cr.Namespace, metricsObjectMetaInfo, redisAsOwner(cr), cr.Spec.RedisExporter, cl)
+	if err != nil {
+		logger.Error(err, "cannot create standalone metrics service for redis")
+		return err
 	}
 
 	return nil
@@ -53,12 +79,21 @@ func generateRedisStandaloneParams(cr *testopv1alpha1.RedisSingle) statefulSetPa
 
 	if cr.Spec.Storage != nil {
 		res.PersistentVolumeClaim = cr.Spec.Storage.VolumeClaimTemplate
+		res.PVCRetentionPolicy = cr.Spec.Storage.PersistentVolumeClaimRetentionPolicy
 	}
 	if cr.Spec.RedisConfig != nil {
 		res.ExternalConfig = cr.Spec.RedisConfig.AdditionalRedisConfig
 	}
+	res.GeneratedConfig = generateRedisSingleConfig(cr)
+	res.ACLFile = isRedis7(cr.Status.RedisVersion)
+	res.WritableConfig = useRedisWritableConfig(cr.Spec.Engine)
+
+	setPodSchedulingParams(&res, cr.Spec.PodScheduling)
 
 	//enable export
+	if cr.Spec.RedisExporter != nil {
+		res.EnableMetrics = true
+	}
 	return res
 }
 
@@ -66,13 +101,17 @@ func generateRedisStandaloneParams(cr *testopv1alpha1.RedisSingle) statefulSetPa
 func generateRedisStandaloneContainerParams(cr *testopv1alpha1.RedisSingle) containerParameters {
 	trueProperty := true
 	containerParams := containerParameters{
-		Image:           cr.Spec.KubernetesConfig.Image,
+		Image:           getRedisEngineImage(cr.Spec.Engine, cr.Spec.KubernetesConfig.Image),
 		ImagePullPolicy: cr.Spec.KubernetesConfig.ImagePullPolicy,
 		Resources:       cr.Spec.KubernetesConfig.Resource,
+		Command:         generateRedisEngineCommand(cr.Spec.Engine),
 	}
 
 	if cr.Spec.Storage != nil {
 		containerParams.PersistenceEnabled = &trueProperty
 	}
+	if cr.Spec.RedisExporter != nil {
+		setRedisExporterParams(cr.Spec.RedisExporter, &containerParams)
+	}
 	return containerParams
 }
@@ -0,0 +1,173 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultRedisUserPasswordKey = "password"
+	redisUserKindSingle         = "RedisSingle"
+	redisUserKindCluster        = "RedisCluster"
+	// redisDefaultUser operator和exporter以default用户无密码连接redis, 不能由RedisUser管理
+	redisDefaultUser = "default"
+)
+
+// GetRedisUserName redis中的用户名, 未设置时使用CR的名称
+func GetRedisUserName(user *v1alpha1.RedisUser) string {
+	if user.Spec.Username != "" {
+		return user.Spec.Username
+	}
+	return user.Name
+}
+
+// ValidateRedisUser 拒绝管理default用户, 设置密码或禁用后operator无法再连接任何节点
+func ValidateRedisUser(user *v1alpha1.RedisUser) error {
+	if GetRedisUserName(user) == redisDefaultUser {
+		return fmt.Errorf("redis user %q is used by the operator and cannot be managed by RedisUser", redisDefaultUser)
+	}
+	return nil
+}
+
+// GetRedisUserSetupType 目标redis对应pod上redis_setup_type的值
+func GetRedisUserSetupType(user *v1alpha1.RedisUser) string {
+	if user.Spec.Redis.Kind == redisUserKindCluster {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// ReconcileRedisUser 在目标redis的每个就绪节点上执行ACL SETUSER并持久化, 返回已设置的pod
+func ReconcileRedisUser(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) ([]string, error) {
+	logger := generateRedisManagerLogger(user.Namespace, user.Name)
+	pods, err := getRedisUserPods(ctx, user, cl)
+	if err != nil {
+		return nil, err
+	}
+	args, err := generateRedisUserRules(ctx, user, cl)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, podName := range sortedRedisPodNames(pods) {
+		if err := executeRedisACLCommand(pods[podName], append([]interface{}{"acl", "setuser"}, args...)); err != nil {
+			logger.Error(err, "set redis acl user failed", "pod", podName, "user", GetRedisUserName(user))
+			return applied, fmt.Errorf("set redis acl user on %s: %v", podName, err)
+		}
+		applied = append(applied, podName)
+	}
+	return applied, nil
+}
+
+// DeleteRedisUser 在目标redis的每个就绪节点上执行ACL DELUSER并持久化, 目标不存在时直接返回
+func DeleteRedisUser(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) error {
+	logger := generateRedisManagerLogger(user.Namespace, user.Name)
+	//default用户不会被设置, 也不能删除
+	if ValidateRedisUser(user) != nil {
+		return nil
+	}
+	pods, err := getRedisUserPods(ctx, user, cl)
+	if err != nil {
+		return err
+	}
+	for _, podName := range sortedRedisPodNames(pods) {
+		if err := executeRedisACLCommand(pods[podName], []interface{}{"acl", "deluser", GetRedisUserName(user)}); err != nil {
+			logger.Error(err, "delete redis acl user failed", "pod", podName, "user", GetRedisUserName(user))
+			return fmt.Errorf("delete redis acl user on %s: %v", podName, err)
+		}
+	}
+	return nil
+}
+
+// getRedisUserPods 获取目标redis所有就绪的pod, 集群包括leader和follower
+func getRedisUserPods(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) (map[string]string, error) {
+	statefulNames := []string{user.Spec.Redis.Name}
+	if user.Spec.Redis.Kind == redisUserKindCluster {
+		statefulNames = []string{user.Spec.Redis.Name + "-" + ClusterRoleLeader, user.Spec.Redis.Name + "-" + ClusterRoleFollower}
+	}
+	pods := map[string]string{}
+	for _, statefulName := range statefulNames {
+		ready, err := getReadyRedisPods(ctx, user.Namespace, statefulName, cl)
+		if err != nil {
+			return nil, err
+		}
+		for name, ip := range ready {
+			pods[name] = ip
+		}
+	}
+	return pods, nil
+}
+
+// sortedRedisPodNames pod名排序, 保证每次按相同的顺序执行
+func sortedRedisPodNames(pods map[string]string) []string {
+	names := make([]string, 0, len(pods))
+	for name := range pods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// generateRedisUserRules 生成ACL SETUSER的参数, 先reset再按spec设置, 保证规则和CR一致
+func generateRedisUserRules(ctx context.Context, user *v1alpha1.RedisUser, cl client.Client) ([]interface{}, error) {
+	args := []interface{}{GetRedisUserName(user), "reset"}
+	if user.Spec.Disabled {
+		args = append(args, "off")
+	} else {
+		args = append(args, "on")
+	}
+
+	if user.Spec.PasswordSecret == nil {
+		args = append(args, "nopass")
+	} else {
+		key := user.Spec.PasswordSecret.Key
+		if key == "" {
+			key = defaultRedisUserPasswordKey
+		}
+		secret := &corev1.Secret{}
+		if err := cl.Get(ctx, types.NamespacedName{Namespace: user.Namespace, Name: user.Spec.PasswordSecret.Name}, secret); err != nil {
+			return nil, err
+		}
+		password, ok := secret.Data[key]
+		if !ok || len(password) == 0 {
+			return nil, fmt.Errorf("password key %s not found in secret %s", key, user.Spec.PasswordSecret.Name)
+		}
+		args = append(args, ">"+string(password))
+	}
+
+	for _, rule := range user.Spec.Rules {
+		for _, field := range strings.Fields(rule) {
+			args = append(args, field)
+		}
+	}
+	return args, nil
+}
+
+// executeRedisACLCommand 执行ACL命令并持久化: 配置了aclfile时ACL SAVE, 否则CONFIG REWRITE写入redis.conf
+func executeRedisACLCommand(ip string, args []interface{}) error {
+	redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+	defer redisClient.Close()
+
+	cmd := redis.NewStatusCmd(args...)
+	if err := redisClient.Process(cmd); err != nil {
+		return err
+	}
+
+	aclFile, err := getRedisConfig(redisClient, "aclfile")
+	if err != nil {
+		return err
+	}
+	if aclFile != "" {
+		return redisClient.Process(redis.NewStatusCmd("acl", "save"))
+	}
+	return redisClient.ConfigRewrite().Err()
+}
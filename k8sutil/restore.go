@@ -0,0 +1,233 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultRestoreImage       = "minio/mc:RELEASE.2021-11-16T20-37-36Z"
+	redisClusterSlots         = 16384
+	redisRestoreContainerName = "restore"
+)
+
+// GetRedisRestoreBackup 获取restoreFrom指向的备份, 备份必须已经完成;
+// 恢复完成后备份可能被清理, statefulSet已经存在时忽略找不到备份
+func GetRedisRestoreBackup(ctx context.Context, namespace, statefulName string, restore *v1alpha1.RestoreFrom, cl client.Client) (*v1alpha1.RedisBackup, error) {
+	if restore == nil {
+		return nil, nil
+	}
+	backup := &v1alpha1.RedisBackup{}
+	if err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: restore.BackupName}, backup); err != nil {
+		if errors.IsNotFound(err) {
+			if _, stsErr := GetStateFulSet(ctx, namespace, statefulName, cl); stsErr == nil {
+				return nil, nil
+			}
+		}
+		return nil, err
+	}
+	if backup.Status.Phase != v1alpha1.BackupPhaseCompleted {
+		return nil, fmt.Errorf("redis backup %s is not completed, phase %q", backup.Name, backup.Status.Phase)
+	}
+	return backup, nil
+}
+
+// getRedisRestoreContainer 获取statefulSet中已有的恢复init container; 恢复完成后备份可能被清理,
+// 沿用已有的容器保持pod模板不变, 避免所有pod因模板变化重启
+func getRedisRestoreContainer(ctx context.Context, namespace, statefulName string, cl client.Client) *corev1.Container {
+	sts, err := GetStateFulSet(ctx, namespace, statefulName, cl)
+	if err != nil {
+		return nil
+	}
+	for _, container := range sts.Spec.Template.Spec.InitContainers {
+		if container.Name == redisRestoreContainerName {
+			return &container
+		}
+	}
+	return nil
+}
+
+// getRedisClusterRestoreRecords 集群备份的记录按起始slot排序, 第i个记录恢复到leader-i
+func getRedisClusterRestoreRecords(backup *v1alpha1.RedisBackup) ([]v1alpha1.BackupRecord, error) {
+	var records []v1alpha1.BackupRecord
+	for _, record := range backup.Status.Records {
+		if len(parseRedisSlots(record.Slots)) == 0 {
+			return nil, fmt.Errorf("redis backup %s record %s has no slots", backup.Name, record.PodName)
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return parseRedisSlots(records[i].Slots)[0] < parseRedisSlots(records[j].Slots)[0]
+	})
+	return records, nil
+}
+
+// parseRedisSlots 解析CLUSTER NODES格式的slot("0-5460", "5461"), 忽略迁移中的slot
+func parseRedisSlots(slots []string) []int {
+	var res []int
+	for _, slot := range slots {
+		if strings.HasPrefix(slot, "[") {
+			continue
+		}
+		bounds := strings.SplitN(slot, "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			continue
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.Atoi(bounds[1]); err != nil {
+				continue
+			}
+		}
+		for i := start; i <= end && i < redisClusterSlots; i++ {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// generateRedisRestoreKeys 生成pod名到备份文件的映射
+func generateRedisRestoreKeys(podPrefix string, records []v1alpha1.BackupRecord) map[string]string {
+	keys := map[string]string{}
+	for i, record := range records {
+		keys[podPrefix+strconv.Itoa(i)] = record.Key
+	}
+	return keys
+}
+
+// generateRedisRestoreContainer 生成下载备份的init container, 数据目录已有数据时直接退出;
+// rdb同时复制为appendonly.aof, 开启AOF时redis会把带RDB前缀的aof文件当作RDB加载
+func generateRedisRestoreContainer(restore *v1alpha1.RestoreFrom, backup *v1alpha1.RedisBackup, volumeName string, keys map[string]string) corev1.Container {
+	image := restore.Image
+	if image == "" {
+		image = defaultRestoreImage
+	}
+
+	pods := make([]string, 0, len(keys))
+	for pod := range keys {
+		pods = append(pods, pod)
+	}
+	sort.Strings(pods)
+	var script strings.Builder
+	script.WriteString("set -e\ncase \"$HOSTNAME\" in\n")
+	for _, pod := range pods {
+		fmt.Fprintf(&script, "  %s) KEY='%s' ;;\n", pod, keys[pod])
+	}
+	script.WriteString("  *) exit 0 ;;\nesac\n")
+	fmt.Fprintf(&script, "if [ -f %[1]s/dump.rdb ] || [ -f %[1]s/appendonly.aof ] || [ -d %[1]s/appendonlydir ]; then exit 0; fi\n", redisDataPath)
+	script.WriteString("mc --config-dir /tmp/mc alias set backup \"$S3_ENDPOINT\" \"$AWS_ACCESS_KEY_ID\" \"$AWS_SECRET_ACCESS_KEY\" > /dev/null\n")
+	fmt.Fprintf(&script, "mc --config-dir /tmp/mc cp \"backup/$S3_BUCKET/$KEY\" %s/dump.rdb.tmp\n", redisDataPath)
+	fmt.Fprintf(&script, "cp %[1]s/dump.rdb.tmp %[1]s/appendonly.aof\n", redisDataPath)
+	fmt.Fprintf(&script, "mv %[1]s/dump.rdb.tmp %[1]s/dump.rdb\n", redisDataPath)
+
+	secretEnv := func(name string) corev1.EnvVar {
+		return corev1.EnvVar{
+			Name: name,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: backup.Spec.Storage.CredentialsSecret},
+					Key:                  name,
+				},
+			},
+		}
+	}
+	return corev1.Container{
+		Name:    redisRestoreContainerName,
+		Image:   image,
+		Command: []string{"sh", "-c", script.String()},
+		Env: []corev1.EnvVar{
+			{Name: "S3_ENDPOINT", Value: backup.Spec.Storage.Endpoint},
+			{Name: "S3_BUCKET", Value: backup.Spec.Storage.Bucket},
+			secretEnv(s3AccessKeyField),
+			secretEnv(s3SecretKeyField),
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      volumeName,
+				MountPath: redisDataPath,
+			},
+		},
+	}
+}
+
+// ExecuteRedisClusterRestoreCommand 用恢复的数据创建集群: 节点中已有数据, 不能使用redis-cli --cluster create,
+// 按备份记录给leader-i分配原master的slot, 再让所有leader互相MEET
+func ExecuteRedisClusterRestoreCommand(ctx context.Context, cr *v1alpha1.RedisCluster, backup *v1alpha1.RedisBackup, cl client.Client) error {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	records, err := getRedisClusterRestoreRecords(backup)
+	if err != nil {
+		logger.Error(err, "invalid redis cluster backup")
+		return err
+	}
+	leaderReplicas := GetRedisLeaderReplicas(cr)
+	if len(records) != int(leaderReplicas) {
+		err := fmt.Errorf("redis backup %s has %d masters, but cluster has %d leaders", backup.Name, len(records), leaderReplicas)
+		logger.Error(err, "cannot restore redis cluster")
+		return err
+	}
+
+	firstLeader, err := configureRedisClient(ctx, cr, cr.Name+"-leader-0", cl)
+	if err != nil {
+		return err
+	}
+	defer firstLeader.Close()
+	for i, record := range records {
+		podName := cr.Name + "-leader-" + strconv.Itoa(i)
+		redisClient, err := configureRedisClient(ctx, cr, podName, cl)
+		if err != nil {
+			return err
+		}
+		nodes, err := redisClient.ClusterNodes().Result()
+		if err != nil {
+			redisClient.Close()
+			logger.Error(err, "redis cluster nodes failed", "pod", podName)
+			return err
+		}
+		// 已经分配过slot的节点不再重复分配
+		if !redisNodeOwnsSlots(nodes) {
+			slots := parseRedisSlots(record.Slots)
+			logger.Info("restore redis cluster slots", "pod", podName, "backup.pod", record.PodName, "slots", record.Slots)
+			if err := redisClient.ClusterAddSlots(slots...).Err(); err != nil {
+				redisClient.Close()
+				logger.Error(err, "redis cluster addslots failed", "pod", podName)
+				return err
+			}
+		}
+		redisClient.Close()
+
+		if i == 0 {
+			continue
+		}
+		ip, err := getRedisServerIP(ctx, RedisDetails{PodName: podName, Namespace: cr.Namespace}, cl)
+		if err != nil {
+			return err
+		}
+		ip = strings.Trim(ip, "[]")
+		if err := firstLeader.ClusterMeet(ip, strconv.Itoa(redisPort)).Err(); err != nil {
+			logger.Error(err, "redis cluster meet failed", "pod", podName)
+			return err
+		}
+	}
+	return nil
+}
+
+// redisNodeOwnsSlots 判断CLUSTER NODES输出中当前节点(myself)是否已有slot
+func redisNodeOwnsSlots(nodes string) bool {
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 8 && strings.Contains(fields[2], "myself") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package k8sutil
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParseRedisSlots(t *testing.T) {
+	tests := []struct {
+		name  string
+		slots []string
+		first int
+		last  int
+		count int
+	}{
+		{name: "range", slots: []string{"0-5460"}, first: 0, last: 5460, count: 5461},
+		{name: "single slots and ranges", slots: []string{"5461", "100-102"}, first: 5461, last: 102, count: 4},
+		{name: "migrating and importing entries are ignored", slots: []string{"[5461->-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca]", "[5462-<-292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f]", "5463"}, first: 5463, last: 5463, count: 1},
+		{name: "out of range slots are dropped", slots: []string{"16380-16390", "20000", "-1"}, first: 16380, last: 16383, count: 4},
+		{name: "reversed or invalid ranges are ignored", slots: []string{"10-5", "a-b", "3-x"}, count: 0},
+		{name: "empty", count: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRedisSlots(tt.slots)
+			if len(got) != tt.count {
+				t.Fatalf("parseRedisSlots(%v) returned %d slots, want %d", tt.slots, len(got), tt.count)
+			}
+			if tt.count == 0 {
+				return
+			}
+			if got[0] != tt.first || got[len(got)-1] != tt.last {
+				t.Errorf("parseRedisSlots(%v) = [%d ... %d], want [%d ... %d]", tt.slots, got[0], got[len(got)-1], tt.first, tt.last)
+			}
+		})
+	}
+}
+
+func TestGetRedisClusterRestoreRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []v1alpha1.BackupRecord
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "records are ordered by the first slot",
+			records: []v1alpha1.BackupRecord{
+				{PodName: "redis-leader-1", Slots: []string{"10923-16383"}},
+				{PodName: "redis-follower-0", Slots: []string{"0-5460"}},
+				{PodName: "redis-leader-2", Slots: []string{"5461-10922"}},
+			},
+			want: []string{"redis-follower-0", "redis-leader-2", "redis-leader-1"},
+		},
+		{
+			name: "migrating entries do not decide the order",
+			records: []v1alpha1.BackupRecord{
+				{PodName: "redis-leader-1", Slots: []string{"[0->-e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca]", "8192-16383"}},
+				{PodName: "redis-leader-0", Slots: []string{"0-8191"}},
+			},
+			want: []string{"redis-leader-0", "redis-leader-1"},
+		},
+		{
+			name: "record without slots",
+			records: []v1alpha1.BackupRecord{
+				{PodName: "redis-leader-0", Slots: []string{"0-16383"}},
+				{PodName: "redis-leader-1"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "record with only out of range slots",
+			records: []v1alpha1.BackupRecord{
+				{PodName: "redis-leader-0", Slots: []string{"16384-20000"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := &v1alpha1.RedisBackup{Status: v1alpha1.RedisBackupStatus{Records: tt.records}}
+			records, err := getRedisClusterRestoreRecords(backup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for _, record := range records {
+				got = append(got, record.PodName)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getRedisClusterRestoreRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetRedisRestoreContainer(t *testing.T) {
+	restore := corev1.Container{Name: redisRestoreContainerName, Image: defaultRestoreImage}
+	tests := []struct {
+		name           string
+		initContainers []corev1.Container
+		want           *corev1.Container
+	}{
+		{name: "restore container is kept", initContainers: []corev1.Container{{Name: "init-acl"}, restore}, want: &restore},
+		{name: "no restore container", initContainers: []corev1.Container{{Name: "init-acl"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "redis-leader"}}
+			sts.Spec.Template.Spec.InitContainers = tt.initContainers
+			cl := fake.NewClientBuilder().WithObjects(sts).Build()
+			if got := getRedisRestoreContainer(context.Background(), "default", "redis-leader", cl); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getRedisRestoreContainer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	cl := fake.NewClientBuilder().Build()
+	if got := getRedisRestoreContainer(context.Background(), "default", "redis-leader", cl); got != nil {
+		t.Errorf("getRedisRestoreContainer() without statefulSet = %v, want nil", got)
+	}
+}
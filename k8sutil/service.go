@@ -4,15 +4,19 @@ import (
 	"context"
 	"github.com/banzaicloud/k8s-objectmatcher/patch"
 	"github.com/go-logr/logr"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 const (
-	redisPort = 6379
+	redisPort    = 6379
+	sentinelPort = 26379
 )
 
 func serviceLogger(namespace string, name string) logr.Logger {
@@ -20,46 +24,72 @@ func serviceLogger(namespace string, name string) logr.Logger {
 }
 
 // CreateOrUpdateHeadlessService method will create or update Redis headless service
-func CreateOrUpdateHeadlessService(namespace string, serviceMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference) error {
-	logger := serviceLogger(namespace, serviceMeta.Name)
-	storedService, err := getService(namespace, serviceMeta.Name)
-	serviceDef := generateHeadlessServiceDef(serviceMeta, ownerDef)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			//set last annotation
-			if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(serviceDef); err != nil {
-				logger.Error(err, "unable to patch redis service with comparison object")
-				return err
-			}
+func CreateOrUpdateHeadlessService(ctx context.Context, namespace string, serviceMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference, cl client.Client) error {
+	return createOrUpdateService(ctx, namespace, generateHeadlessServiceDef(serviceMeta, ownerDef, redisPort), cl)
+}
 
-			return createService(namespace, serviceDef)
+func CreateOrUpdateService(ctx context.Context, namespace string, serviceMeta metav1.ObjectMeta, ownerRef metav1.OwnerReference, cl client.Client) error {
+	return createOrUpdateService(ctx, namespace, generateServiceDef(serviceMeta, serviceMeta.Labels, ownerRef, redisPort), cl)
+}
+
+// CreateOrUpdateSelectorService 创建或更新自定义selector的service, 比如只指向master的service
+func CreateOrUpdateSelectorService(ctx context.Context, namespace string, serviceMeta metav1.ObjectMeta, selector map[string]string, ownerRef metav1.OwnerReference, cl client.Client) error {
+	return createOrUpdateService(ctx, namespace, generateServiceDef(serviceMeta, selector, ownerRef, redisPort), cl)
+}
+
+// CreateOrUpdateExternalService 按spec.service设置类型、注解和来源网段, 未配置时是ClusterIP的service
+func CreateOrUpdateExternalService(ctx context.Context, namespace string, serviceMeta metav1.ObjectMeta, selector map[string]string, serviceSpec *v1alpha1.RedisService, ownerRef metav1.OwnerReference, cl client.Client) error {
+	service := generateServiceDef(serviceMeta, selector, ownerRef, redisPort)
+	setRedisServiceSpec(service, serviceSpec)
+	return createOrUpdateService(ctx, namespace, service, cl)
+}
+
+// setRedisServiceSpec 把spec.service的配置写入service定义
+func setRedisServiceSpec(service *corev1.Service, serviceSpec *v1alpha1.RedisService) {
+	if serviceSpec == nil {
+		return
+	}
+	service.Spec.Type = generateServiceType(serviceSpec.Type)
+	if len(serviceSpec.Annotations) > 0 {
+		annotations := map[string]string{}
+		for k, v := range service.Annotations {
+			annotations[k] = v
 		}
-		return err
+		for k, v := range serviceSpec.Annotations {
+			annotations[k] = v
+		}
+		service.Annotations = annotations
+	}
+	if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		service.Spec.LoadBalancerSourceRanges = serviceSpec.LoadBalancerSourceRanges
 	}
-
-	return patchService(storedService, serviceDef, namespace)
 }
 
-func CreateOrUpdateService(namespace string, serviceMeta metav1.ObjectMeta, ownerRef metav1.OwnerReference) error {
-	logger := serviceLogger(namespace, serviceMeta.Name)
-	serviceDef := generateServiceDef(serviceMeta, serviceMeta.Labels, ownerRef)
-	storedService, err := getService(namespace, serviceMeta.Name)
+// createOrUpdateService 不存在时创建service, 存在时patch
+func createOrUpdateService(ctx context.Context, namespace string, serviceDef *corev1.Service, cl client.Client) error {
+	logger := serviceLogger(namespace, serviceDef.Name)
+	storedService, err := getService(ctx, namespace, serviceDef.Name, cl)
 	if err != nil {
 		if errors.IsNotFound(err) {
+			//set last annotation
 			if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(serviceDef); err != nil {
-				logger.Error(err, "unable to patch redis service with compare annotations")
+				logger.Error(err, "unable to patch redis service with comparison object")
+				return err
 			}
-			return createService(namespace, serviceDef)
+
+			return createService(ctx, namespace, serviceDef, cl)
 		}
 		return err
 	}
-	return patchService(storedService, serviceDef, namespace)
+
+	return patchService(ctx, storedService, serviceDef, namespace, cl)
 }
 
 // getService 获取service
-func getService(namespace string, serviceName string) (*corev1.Service, error) {
+func getService(ctx context.Context, namespace string, serviceName string, cl client.Client) (*corev1.Service, error) {
 	logger := serviceLogger(namespace, serviceName)
-	serviceInfo, err := generateK8sClient().CoreV1().Services(namespace).Get(context.TODO(), serviceName, metav1.GetOptions{})
+	serviceInfo := &corev1.Service{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: serviceName}, serviceInfo)
 	if err != nil {
 		logger.Error(err, "Redis service get failed")
 		return nil, err
@@ -69,9 +99,9 @@ func getService(namespace string, serviceName string) (*corev1.Service, error) {
 }
 
 // updateService 更新service
-func updateService(namespace string, service *corev1.Service) error {
+func updateService(ctx context.Context, namespace string, service *corev1.Service, cl client.Client) error {
 	logger := serviceLogger(namespace, service.Name)
-	_, err := generateK8sClient().CoreV1().Services(namespace).Update(context.TODO(), service, metav1.UpdateOptions{})
+	err := cl.Update(ctx, service)
 	if err != nil {
 		logger.Error(err, "Redis service update failed")
 		return err
@@ -81,9 +111,9 @@ func updateService(namespace string, service *corev1.Service) error {
 }
 
 // createService 创建service
-func createService(namespace string, service *corev1.Service) error {
+func createService(ctx context.Context, namespace string, service *corev1.Service, cl client.Client) error {
 	logger := serviceLogger(namespace, service.Name)
-	_, err := generateK8sClient().CoreV1().Services(namespace).Create(context.TODO(), service, metav1.CreateOptions{})
+	err := cl.Create(ctx, service)
 	if err != nil {
 		logger.Error(err, "Redis service create failed")
 		return err
@@ -93,7 +123,7 @@ func createService(namespace string, service *corev1.Service) error {
 }
 
 // patchService
-func patchService(storedService *corev1.Service, newService *corev1.Service, namespace string) error {
+func patchService(ctx context.Context, storedService *corev1.Service, newService *corev1.Service, namespace string, cl client.Client) error {
 	logger := serviceLogger(namespace, storedService.Name)
 	patchResult, err := patch.DefaultPatchMaker.Calculate(storedService, newService, patch.IgnoreStatusFields())
 	if err != nil {
@@ -103,9 +133,23 @@ func patchService(storedService *corev1.Service, newService *corev1.Service, nam
 
 	if !patchResult.IsEmpty() {
 		newService.Spec.ClusterIP = storedService.Spec.ClusterIP
+		newService.Spec.ClusterIPs = storedService.Spec.ClusterIPs
+		//保留已分配的nodePort, 避免更新时重新分配导致对外地址变化
+		if newService.Spec.Type == corev1.ServiceTypeNodePort || newService.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			for i := range newService.Spec.Ports {
+				for _, port := range storedService.Spec.Ports {
+					if port.Name == newService.Spec.Ports[i].Name && newService.Spec.Ports[i].NodePort == 0 {
+						newService.Spec.Ports[i].NodePort = port.NodePort
+					}
+				}
+			}
+		}
 		newService.ResourceVersion = storedService.ResourceVersion
 		newService.CreationTimestamp = storedService.CreationTimestamp
 		newService.ManagedFields = storedService.ManagedFields
+		if newService.Annotations == nil {
+			newService.Annotations = map[string]string{}
+		}
 		for key, value := range storedService.Annotations {
 			if _, present := newService.Annotations[key]; !present {
 				newService.Annotations[key] = value
@@ -117,7 +161,7 @@ func patchService(storedService *corev1.Service, newService *corev1.Service, nam
 		}
 
 		logger.Info("syncing redis service with defined properties")
-		return updateService(namespace, newService)
+		return updateService(ctx, namespace, newService, cl)
 	}
 
 	logger.Info("redis service is already in-sync")
@@ -139,44 +183,48 @@ func generateServiceType(k8sServiceType string) corev1.ServiceType {
 	return serviceType
 }
 
-func generateHeadlessServiceDef(serviceMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference) *corev1.Service {
+func generateHeadlessServiceDef(serviceMeta metav1.ObjectMeta, ownerDef metav1.OwnerReference, port int) *corev1.Service {
 	service := &corev1.Service{
 		TypeMeta:   generateTypeMeta("Service", "core/v1"),
 		ObjectMeta: serviceMeta,
 		Spec: corev1.ServiceSpec{
 			ClusterIP: "None", //表明是无头service
 			Selector:  serviceMeta.Labels,
-			Ports: []corev1.ServicePort{
-				{
-					Name:       "redis-client",
-					Port:       redisPort,
-					TargetPort: intstr.FromInt(redisPort),
-					Protocol:   corev1.ProtocolTCP,
-				},
-			},
+			Ports:     generateServicePorts(port),
+			//未就绪的pod也需要域名, 集群节点启动时通过域名互相握手
+			PublishNotReadyAddresses: true,
 		},
 	}
 	AddOwnerRefToObject(service, ownerDef)
 	return service
 }
 
-func generateServiceDef(serviceMeta metav1.ObjectMeta, labels map[string]string, ownerRef metav1.OwnerReference) *corev1.Service {
+func generateServiceDef(serviceMeta metav1.ObjectMeta, labels map[string]string, ownerRef metav1.OwnerReference, port int) *corev1.Service {
 	service := &corev1.Service{
 		TypeMeta:   generateTypeMeta("service", "core/v1"),
 		ObjectMeta: serviceMeta,
 		Spec: corev1.ServiceSpec{
 			Type:     corev1.ServiceTypeClusterIP,
 			Selector: labels,
-			Ports: []corev1.ServicePort{
-				{
-					Name:       "redis-client",
-					Port:       redisPort,
-					TargetPort: intstr.FromInt(redisPort),
-					Protocol:   corev1.ProtocolTCP,
-				},
-			},
+			Ports:    generateServicePorts(port),
 		},
 	}
 	AddOwnerRefToObject(service, ownerRef)
 	return service
 }
+
+// generateServicePorts 生成service端口, redis和sentinel使用不同的端口
+func generateServicePorts(port int) []corev1.ServicePort {
+	name := "redis-client"
+	if port == sentinelPort {
+		name = "sentinel-client"
+	}
+	return []corev1.ServicePort{
+		{
+			Name:       name,
+			Port:       int32(port),
+			TargetPort: intstr.FromInt(port),
+			Protocol:   corev1.ProtocolTCP,
+		},
+	}
+}
@@ -4,13 +4,23 @@ import (
 	"context"
 	"github.com/banzaicloud/k8s-objectmatcher/patch"
 	"github.com/go-logr/logr"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const (
+	redisDataPath            = "/data"
+	externalConfigPath       = "/etc/redis/external.conf.d"
+	externalConfigFile       = "redis-external.conf"
+	externalConfigVolumeName = "external-config"
+)
+
 // statefulSetParameters will define statefulsets input params
 type statefulSetParameters struct {
 	Replicas              *int32
@@ -24,15 +34,42 @@ type statefulSetParameters struct {
 	PersistentVolumeClaim corev1.PersistentVolumeClaim
 	ImagePullSecrets      *[]corev1.LocalObjectReference
 	ExternalConfig        *string
+	// GeneratedConfig operator根据CR生成的redis参数, 和ExternalConfig合并后写入<name>-config
+	GeneratedConfig map[string]string
+	// ACLFile 挂载ACL文件的目录, 并在启动前创建空的ACL文件
+	ACLFile bool
+	// WritableConfig 启动前把生成的配置复制到emptyDir, 服务端直接使用该配置启动
+	WritableConfig bool
+	// ServiceName statefulSet的governing service, 为空时使用statefulSet的名称
+	ServiceName       string
+	AdditionalVolumes []corev1.Volume
+	InitContainers    []corev1.Container
+
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint
+	ServiceAccountName        string
+	PodLabels                 map[string]string
+	PodAnnotations            map[string]string
+	// ConfigHash 需要重启的redis参数的hash, 由ExternalConfig计算
+	ConfigHash string
+	// UpdateStrategy 为空时使用statefulSet默认的RollingUpdate
+	UpdateStrategy     appsv1.StatefulSetUpdateStrategy
+	PVCRetentionPolicy *v1alpha1.PVCRetentionPolicy
 }
 
 // containerParameters will define container input params
 type containerParameters struct {
-	Image              string
-	ImagePullPolicy    corev1.PullPolicy
-	Resources          *corev1.ResourceRequirements
-	PersistenceEnabled *bool
-	Role               string
+	Image               string
+	ImagePullPolicy     corev1.PullPolicy
+	Resources           *corev1.ResourceRequirements
+	PersistenceEnabled  *bool
+	Role                string
+	Command             []string
+	AdditionalMountPath []corev1.VolumeMount
+
+	RedisExporterImage           string
+	RedisExporterImagePullPolicy corev1.PullPolicy
+	RedisExporterResources       *corev1.ResourceRequirements
+	RedisExporterPort            *int32
 }
 
 func getStatefulLog(namespace, name string) logr.Logger {
@@ -40,9 +77,21 @@ func getStatefulLog(namespace, name string) logr.Logger {
 }
 
 //CreateOrUpdateStatefulSet 创建或生成StatefulSet
-func CreateOrUpdateStatefulSet(namespace string, stsMeta metav1.ObjectMeta, params statefulSetParameters, ownerDef metav1.OwnerReference, containerParams containerParameters) error {
+func CreateOrUpdateStatefulSet(ctx context.Context, namespace string, stsMeta metav1.ObjectMeta, params statefulSetParameters, ownerDef metav1.OwnerReference, containerParams containerParameters, cl client.Client) error {
 	logger := getStatefulLog(namespace, stsMeta.Name)
-	storedStateful, err := GetStateFulSet(namespace, stsMeta.Name)
+	externalConfig, err := reconcileRedisGeneratedConfig(ctx, namespace, stsMeta, params, ownerDef, cl)
+	if err != nil {
+		logger.Error(err, "generate redis config failed")
+		return err
+	}
+	params.ExternalConfig = externalConfig
+	configHash, err := getRedisConfigHash(ctx, namespace, params.ExternalConfig, cl)
+	if err != nil {
+		logger.Error(err, "get redis external config failed")
+		return err
+	}
+	params.ConfigHash = configHash
+	storedStateful, err := GetStateFulSet(ctx, namespace, stsMeta.Name, cl)
 	statefulSetDef := generateStateFulSetsDef(stsMeta, params, ownerDef, containerParams)
 	if err != nil {
 		if err := patch.DefaultAnnotator.SetLastAppliedAnnotation(statefulSetDef); err != nil {
@@ -52,18 +101,33 @@ func CreateOrUpdateStatefulSet(namespace string, stsMeta metav1.ObjectMeta, para
 
 		if errors.IsNotFound(err) {
 			logger.Info("statefulset not find , begin create ")
-			return createStatefulSet(namespace, statefulSetDef)
+			return createStatefulSet(ctx, namespace, statefulSetDef, cl)
 		}
 		return err
 	}
+	//serviceName不能修改, 只能以orphan方式删除后重建, pod由新的statefulSet接管
+	if storedStateful.Spec.ServiceName != statefulSetDef.Spec.ServiceName {
+		logger.Info("redis statefulset serviceName changed, recreating", "from", storedStateful.Spec.ServiceName, "to", statefulSetDef.Spec.ServiceName)
+		return recreateStatefulSet(ctx, namespace, storedStateful, cl)
+	}
+	if isStatefulSetStorageExpanded(storedStateful, statefulSetDef) {
+		if err := expandStatefulSetPVCs(ctx, namespace, storedStateful, statefulSetDef, cl); err != nil {
+			logger.Error(err, "redis storage expansion failed")
+			return &StorageExpansionError{Err: err}
+		}
+		return recreateStatefulSet(ctx, namespace, storedStateful, cl)
+	}
 	logger.Info("Redis statefulSet begin patch")
-	return patchStatefulSet(storedStateful, statefulSetDef, namespace)
+	if err := patchStatefulSet(ctx, storedStateful, statefulSetDef, namespace, cl); err != nil {
+		return err
+	}
+	return reconcilePVCRetention(ctx, namespace, storedStateful, params.PVCRetentionPolicy, ownerDef, cl)
 }
 
 //createStatefulSet 创建redis stateful set
-func createStatefulSet(namespace string, stateful *appsv1.StatefulSet) error {
+func createStatefulSet(ctx context.Context, namespace string, stateful *appsv1.StatefulSet, cl client.Client) error {
 	logger := getStatefulLog(namespace, stateful.Name)
-	_, err := generateK8sClient().AppsV1().StatefulSets(namespace).Create(context.TODO(), stateful, metav1.CreateOptions{})
+	err := cl.Create(ctx, stateful)
 	logger.Info("create statefulset pvc:", "pvc", stateful.Spec.VolumeClaimTemplates)
 	if err != nil {
 		logger.Error(err, "Redis Stateful create failed")
@@ -74,9 +138,9 @@ func createStatefulSet(namespace string, stateful *appsv1.StatefulSet) error {
 }
 
 // updateStatefulSet更新statefulset状态
-func updateStatefulSet(namespace string, stateful *appsv1.StatefulSet) error {
+func updateStatefulSet(ctx context.Context, namespace string, stateful *appsv1.StatefulSet, cl client.Client) error {
 	logger := getStatefulLog(namespace, stateful.Name)
-	_, err := generateK8sClient().AppsV1().StatefulSets(namespace).Update(context.TODO(), stateful, metav1.UpdateOptions{})
+	err := cl.Update(ctx, stateful)
 	if err != nil {
 		logger.Error(err, "Redis StatefulSet update failed")
 		return err
@@ -86,9 +150,10 @@ func updateStatefulSet(namespace string, stateful *appsv1.StatefulSet) error {
 }
 
 // GetStateFulSet 获取Redis StatefulSet
-func GetStateFulSet(namespace string, statefulName string) (*appsv1.StatefulSet, error) {
+func GetStateFulSet(ctx context.Context, namespace string, statefulName string, cl client.Client) (*appsv1.StatefulSet, error) {
 	logger := getStatefulLog(namespace, statefulName)
-	statefulSet, err := generateK8sClient().AppsV1().StatefulSets(namespace).Get(context.TODO(), statefulName, metav1.GetOptions{})
+	statefulSet := &appsv1.StatefulSet{}
+	err := cl.Get(ctx, types.NamespacedName{Namespace: namespace, Name: statefulName}, statefulSet)
 	if err != nil {
 		logger.Error(err, "Redis StatefulSet Get failed")
 		return nil, err
@@ -98,7 +163,7 @@ func GetStateFulSet(namespace string, statefulName string) (*appsv1.StatefulSet,
 }
 
 //patchStatefulSet patch redis kubenetes statefulSet
-func patchStatefulSet(storedStateful *appsv1.StatefulSet, newStateful *appsv1.StatefulSet, namespace string) error {
+func patchStatefulSet(ctx context.Context, storedStateful *appsv1.StatefulSet, newStateful *appsv1.StatefulSet, namespace string, cl client.Client) error {
 	logger := getStatefulLog(namespace, storedStateful.Name)
 	patchResult, err := patch.DefaultPatchMaker.Calculate(storedStateful, newStateful)
 	if err != nil {
@@ -120,7 +185,7 @@ func patchStatefulSet(storedStateful *appsv1.StatefulSet, newStateful *appsv1.St
 			logger.Error(err, "unable to patch redis statefulset with comparison object")
 			return err
 		}
-		return updateStatefulSet(namespace, newStateful)
+		return updateStatefulSet(ctx, namespace, newStateful, cl)
 	}
 	return nil
 }
@@ -134,13 +199,14 @@ func generateStateFulSetsDef(stsMeta metav1.ObjectMeta, params statefulSetParame
 		},
 		ObjectMeta: stsMeta,
 		Spec: appsv1.StatefulSetSpec{
-			Selector:    LabelSelectors(stsMeta.GetLabels()),
-			ServiceName: stsMeta.Name,
-			Replicas:    params.Replicas,
+			Selector:       LabelSelectors(stsMeta.GetLabels()),
+			ServiceName:    stsMeta.Name,
+			Replicas:       params.Replicas,
+			UpdateStrategy: params.UpdateStrategy,
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
-					Labels:      stsMeta.GetLabels(),
-					Annotations: generateStatefulSetsAnots(stsMeta),
+					Labels:      generatePodLabels(stsMeta.GetLabels(), params.PodLabels),
+					Annotations: generatePodAnnotations(stsMeta, params.PodAnnotations),
 				},
 				Spec: corev1.PodSpec{
 					Containers: []corev1.Container{
@@ -148,20 +214,69 @@ func generateStateFulSetsDef(stsMeta metav1.ObjectMeta, params statefulSetParame
 							Name:            stsMeta.GetName(),
 							Image:           containerParams.Image,
 							ImagePullPolicy: containerParams.ImagePullPolicy,
-							//Env:
-
+							Command:         containerParams.Command,
+							VolumeMounts:    containerParams.AdditionalMountPath,
+							Env:             generateContainerEnv(params, containerParams),
 						},
 					},
+					InitContainers:    params.InitContainers,
+					Volumes:           params.AdditionalVolumes,
 					NodeSelector:      params.NodeSelector,
 					SecurityContext:   params.SecurityContext,
 					PriorityClassName: params.PriorityClassName,
 					Affinity:          params.Affinity,
+
+					TopologySpreadConstraints: params.TopologySpreadConstraints,
+					ServiceAccountName:        params.ServiceAccountName,
 				},
 			},
 		},
 	}
 	if containerParams.PersistenceEnabled != nil && *containerParams.PersistenceEnabled {
 		statefulset.Spec.VolumeClaimTemplates = append(statefulset.Spec.VolumeClaimTemplates, createPVCTemplate(stsMeta, params.PersistentVolumeClaim))
+		statefulset.Spec.Template.Spec.Containers[0].VolumeMounts = append(statefulset.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      stsMeta.GetName(),
+			MountPath: redisDataPath,
+		})
+	}
+
+	if containerParams.Resources != nil {
+		statefulset.Spec.Template.Spec.Containers[0].Resources = *containerParams.Resources
+	}
+	if params.ExternalConfig != nil {
+		statefulset.Spec.Template.Spec.Volumes = append(statefulset.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: externalConfigVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: *params.ExternalConfig},
+				},
+			},
+		})
+		statefulset.Spec.Template.Spec.Containers[0].VolumeMounts = append(statefulset.Spec.Template.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      externalConfigVolumeName,
+			MountPath: externalConfigPath,
+		})
+	}
+	if params.ServiceName != "" {
+		statefulset.Spec.ServiceName = params.ServiceName
+	}
+	if params.ACLFile {
+		setRedisACLFileVolume(statefulset, containerParams)
+	}
+	if params.WritableConfig && params.ExternalConfig != nil {
+		setRedisWritableConfigVolume(statefulset, containerParams)
+	}
+	if params.ConfigHash != "" {
+		statefulset.Spec.Template.Annotations[RedisConfigHashAnnotation] = params.ConfigHash
+	}
+	if params.Tolerations != nil {
+		statefulset.Spec.Template.Spec.Tolerations = *params.Tolerations
+	}
+	if params.ImagePullSecrets != nil {
+		statefulset.Spec.Template.Spec.ImagePullSecrets = *params.ImagePullSecrets
+	}
+	if params.EnableMetrics {
+		statefulset.Spec.Template.Spec.Containers = append(statefulset.Spec.Template.Spec.Containers, generateRedisExporterContainer(containerParams))
 	}
 
 	AddOwnerRefToObject(statefulset, ownerDef)
@@ -169,6 +284,114 @@ func generateStateFulSetsDef(stsMeta metav1.ObjectMeta, params statefulSetParame
 	return statefulset
 }
 
+// setRedisACLFileVolume 开启持久化时ACL文件保存在数据PVC的acl子目录, 否则使用emptyDir;
+// redis在aclfile不存在时无法启动, 由init container先创建空文件
+func setRedisACLFileVolume(statefulset *appsv1.StatefulSet, containerParams containerParameters) {
+	mount := corev1.VolumeMount{Name: redisACLVolumeName, MountPath: redisACLPath}
+	if containerParams.PersistenceEnabled != nil && *containerParams.PersistenceEnabled {
+		mount.Name = statefulset.Name
+		mount.SubPath = "acl"
+	} else {
+		statefulset.Spec.Template.Spec.Volumes = append(statefulset.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name:         redisACLVolumeName,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+	}
+	statefulset.Spec.Template.Spec.Containers[0].VolumeMounts = append(statefulset.Spec.Template.Spec.Containers[0].VolumeMounts, mount)
+	statefulset.Spec.Template.Spec.InitContainers = append(statefulset.Spec.Template.Spec.InitContainers, corev1.Container{
+		Name:            "init-acl",
+		Image:           containerParams.Image,
+		ImagePullPolicy: containerParams.ImagePullPolicy,
+		Command:         []string{"sh", "-c", "touch " + redisACLFile},
+		VolumeMounts:    []corev1.VolumeMount{mount},
+	})
+}
+
+// setRedisWritableConfigVolume configMap挂载只读, 由init container复制到emptyDir, 保证CONFIG REWRITE可以写回配置文件
+func setRedisWritableConfigVolume(statefulset *appsv1.StatefulSet, containerParams containerParameters) {
+	mount := corev1.VolumeMount{Name: redisWritableConfigVolumeName, MountPath: redisWritableConfigPath}
+	statefulset.Spec.Template.Spec.Volumes = append(statefulset.Spec.Template.Spec.Volumes, corev1.Volume{
+		Name:         redisWritableConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	})
+	statefulset.Spec.Template.Spec.Containers[0].VolumeMounts = append(statefulset.Spec.Template.Spec.Containers[0].VolumeMounts, mount)
+	statefulset.Spec.Template.Spec.InitContainers = append(statefulset.Spec.Template.Spec.InitContainers, corev1.Container{
+		Name:            "init-config",
+		Image:           containerParams.Image,
+		ImagePullPolicy: containerParams.ImagePullPolicy,
+		Command:         []string{"sh", "-c", "cp " + externalConfigPath + "/" + externalConfigFile + " " + redisWritableConfigFile},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: externalConfigVolumeName, MountPath: externalConfigPath, ReadOnly: true},
+			mount,
+		},
+	})
+}
+
+// generateContainerEnv 生成redis镜像启动脚本使用的环境变量
+func generateContainerEnv(params statefulSetParameters, containerParams containerParameters) []corev1.EnvVar {
+	setupMode := "standalone"
+	if containerParams.Role == "cluster" {
+		setupMode = "cluster"
+	}
+	env := []corev1.EnvVar{
+		{Name: "SETUP_MODE", Value: setupMode},
+	}
+	if containerParams.PersistenceEnabled != nil && *containerParams.PersistenceEnabled {
+		env = append(env, corev1.EnvVar{Name: "PERSISTENCE_ENABLED", Value: "true"})
+	}
+	if params.ExternalConfig != nil {
+		env = append(env, corev1.EnvVar{Name: "EXTERNAL_CONFIG_FILE", Value: externalConfigPath + "/" + externalConfigFile})
+	}
+	return env
+}
+
+// setPodSchedulingParams 把CR中的调度配置写入statefulSet参数, 用户配置的反亲和性覆盖默认值
+func setPodSchedulingParams(params *statefulSetParameters, scheduling *v1alpha1.PodScheduling) {
+	if scheduling == nil {
+		return
+	}
+	if scheduling.Affinity != nil {
+		affinity := scheduling.Affinity.DeepCopy()
+		if affinity.PodAntiAffinity == nil && params.Affinity != nil {
+			affinity.PodAntiAffinity = params.Affinity.PodAntiAffinity
+		}
+		params.Affinity = affinity
+	}
+	if scheduling.Tolerations != nil {
+		params.Tolerations = &scheduling.Tolerations
+	}
+	if scheduling.ImagePullSecrets != nil {
+		params.ImagePullSecrets = &scheduling.ImagePullSecrets
+	}
+	params.TopologySpreadConstraints = scheduling.TopologySpreadConstraints
+	params.PriorityClassName = scheduling.PriorityClassName
+	params.SecurityContext = scheduling.SecurityContext
+	params.ServiceAccountName = scheduling.ServiceAccountName
+	params.PodLabels = scheduling.PodLabels
+	params.PodAnnotations = scheduling.PodAnnotations
+}
+
+// generatePodLabels 额外的标签不能覆盖selector使用的标签
+func generatePodLabels(selectorLabels, podLabels map[string]string) map[string]string {
+	labels := map[string]string{}
+	for k, v := range podLabels {
+		labels[k] = v
+	}
+	for k, v := range selectorLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// generatePodAnnotations 生成pod注解
+func generatePodAnnotations(stsMeta metav1.ObjectMeta, podAnnotations map[string]string) map[string]string {
+	annotations := generateStatefulSetsAnots(stsMeta)
+	for k, v := range podAnnotations {
+		annotations[k] = v
+	}
+	return annotations
+}
+
 func createPVCTemplate(stsMeta metav1.ObjectMeta, storageSpec corev1.PersistentVolumeClaim) corev1.PersistentVolumeClaim {
 	pvcTemplate := storageSpec
 	pvcTemplate.CreationTimestamp = metav1.Time{}
@@ -0,0 +1,504 @@
+package k8sutil
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	hostnameTopologyKey   = "kubernetes.io/hostname"
+	zoneTopologyKey       = "topology.kubernetes.io/zone"
+	legacyZoneTopologyKey = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// redisPodPlacement 记录redis pod所在的节点和可用区
+type redisPodPlacement struct {
+	PodName string
+	IP      string
+	Node    string
+	Zone    string
+}
+
+// 主从分配满足的规则, 从严到宽
+const (
+	RedisPlacementNodeAndZone = "NodeAndZone"
+	RedisPlacementNode        = "Node"
+	RedisPlacementAny         = "Any"
+)
+
+// placementRule 判断follower能否作为leader的副本
+type placementRule struct {
+	Name  string
+	Match func(leader, follower redisPodPlacement) bool
+}
+
+// differentNodeAndZone 主从既不在同一节点也不在同一可用区
+func differentNodeAndZone(leader, follower redisPodPlacement) bool {
+	return differentNode(leader, follower) && (leader.Zone == "" || leader.Zone != follower.Zone)
+}
+
+// differentNode 主从不在同一节点
+func differentNode(leader, follower redisPodPlacement) bool {
+	return leader.Node != follower.Node
+}
+
+// anyPlacement 拓扑无法满足时兜底, 由controller记录Warning事件和condition
+func anyPlacement(leader, follower redisPodPlacement) bool {
+	return true
+}
+
+// placementRules 按优先级从严到宽排列
+var placementRules = []placementRule{
+	{Name: RedisPlacementNodeAndZone, Match: differentNodeAndZone},
+	{Name: RedisPlacementNode, Match: differentNode},
+	{Name: RedisPlacementAny, Match: anyPlacement},
+}
+
+// getRedisZoneLabelKey 节点上表示可用区的标签, 默认topology.kubernetes.io/zone
+func getRedisZoneLabelKey(cr *v1alpha1.RedisCluster) string {
+	if cr.Spec.Topology != nil && cr.Spec.Topology.ZoneLabelKey != "" {
+		return cr.Spec.Topology.ZoneLabelKey
+	}
+	return zoneTopologyKey
+}
+
+// generateRedisClusterAffinity 生成集群角色的pod反亲和性，同角色的pod尽量分散到不同节点和可用区,
+// 并尽量不和另一个角色的pod在同一节点; 每个可用区都会有leader, 跨角色不再限制可用区, 由主从分配保证副本在其他可用区
+func generateRedisClusterAffinity(cr *v1alpha1.RedisCluster, role string) *corev1.Affinity {
+	selector := LabelSelectors(map[string]string{
+		"app":  cr.ObjectMeta.Name + "-" + role,
+		"role": role,
+	})
+	otherRole := ClusterRoleFollower
+	if role == ClusterRoleFollower {
+		otherRole = ClusterRoleLeader
+	}
+	otherSelector := LabelSelectors(map[string]string{
+		"app":  cr.ObjectMeta.Name + "-" + otherRole,
+		"role": otherRole,
+	})
+	return &corev1.Affinity{
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+				{
+					Weight: 100,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: selector,
+						TopologyKey:   hostnameTopologyKey,
+					},
+				},
+				{
+					Weight: 50,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: selector,
+						TopologyKey:   getRedisZoneLabelKey(cr),
+					},
+				},
+				{
+					Weight: 80,
+					PodAffinityTerm: corev1.PodAffinityTerm{
+						LabelSelector: otherSelector,
+						TopologyKey:   hostnameTopologyKey,
+					},
+				},
+			},
+		},
+	}
+}
+
+// appendRedisZoneSpread 配置了topology时给角色追加按可用区均匀分布的约束, 用户已配置同一个topologyKey时不覆盖
+func appendRedisZoneSpread(constraints []corev1.TopologySpreadConstraint, cr *v1alpha1.RedisCluster, role string) []corev1.TopologySpreadConstraint {
+	topology := cr.Spec.Topology
+	if topology == nil {
+		return constraints
+	}
+	zoneKey := getRedisZoneLabelKey(cr)
+	for _, constraint := range constraints {
+		if constraint.TopologyKey == zoneKey {
+			return constraints
+		}
+	}
+	constraint := corev1.TopologySpreadConstraint{
+		MaxSkew:           1,
+		TopologyKey:       zoneKey,
+		WhenUnsatisfiable: corev1.DoNotSchedule,
+		LabelSelector: LabelSelectors(map[string]string{
+			"app":  cr.ObjectMeta.Name + "-" + role,
+			"role": role,
+		}),
+	}
+	if topology.MaxSkew != nil {
+		constraint.MaxSkew = *topology.MaxSkew
+	}
+	if topology.WhenUnsatisfiable != "" {
+		constraint.WhenUnsatisfiable = topology.WhenUnsatisfiable
+	}
+	return append(constraints, constraint)
+}
+
+// getRedisPodPlacements 获取某个角色所有pod的节点和可用区信息
+func getRedisPodPlacements(ctx context.Context, cr *v1alpha1.RedisCluster, role string, cl client.Client) ([]redisPodPlacement, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	pods := &corev1.PodList{}
+	err := cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels{
+		"app":  cr.ObjectMeta.Name + "-" + role,
+		"role": role,
+	})
+	if err != nil {
+		logger.Error(err, "list redis pods failed", "role", role)
+		return nil, err
+	}
+
+	zoneKey := getRedisZoneLabelKey(cr)
+	zones := map[string]string{}
+	var placements []redisPodPlacement
+	for _, pod := range pods.Items {
+		if pod.Status.PodIP == "" || pod.Spec.NodeName == "" {
+			continue
+		}
+		zone, ok := zones[pod.Spec.NodeName]
+		if !ok {
+			zone = getNodeZone(ctx, pod.Spec.NodeName, zoneKey, cl)
+			zones[pod.Spec.NodeName] = zone
+		}
+		placements = append(placements, redisPodPlacement{
+			PodName: pod.Name,
+			IP:      pod.Status.PodIP,
+			Node:    pod.Spec.NodeName,
+			Zone:    zone,
+		})
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].PodName < placements[j].PodName
+	})
+	return placements, nil
+}
+
+// getNodeZone 获取节点所在的可用区, 使用默认标签时兼容旧的failure-domain标签
+func getNodeZone(ctx context.Context, nodeName, zoneKey string, cl client.Client) string {
+	node := &corev1.Node{}
+	if err := cl.Get(ctx, types.NamespacedName{Name: nodeName}, node); err != nil {
+		return ""
+	}
+	if zone, ok := node.Labels[zoneKey]; ok || zoneKey != zoneTopologyKey {
+		return zone
+	}
+	return node.Labels[legacyZoneTopologyKey]
+}
+
+// orderRedisLeadersByZone 按可用区轮流排列leader, redis-cli --cluster create按顺序分配连续的slot区间,
+// 相邻的slot区间落在不同的可用区
+func orderRedisLeadersByZone(leaders []redisPodPlacement) []string {
+	var zones []string
+	byZone := map[string][]string{}
+	for _, leader := range leaders {
+		if _, ok := byZone[leader.Zone]; !ok {
+			zones = append(zones, leader.Zone)
+		}
+		byZone[leader.Zone] = append(byZone[leader.Zone], leader.PodName)
+	}
+	sort.Strings(zones)
+	var res []string
+	for i := 0; len(res) < len(leaders); i++ {
+		for _, zone := range zones {
+			if i < len(byZone[zone]) {
+				res = append(res, byZone[zone][i])
+			}
+		}
+	}
+	return res
+}
+
+// matchRedisReplicas 按规则为每个follower分配leader, 优先保留当前的主从关系
+func matchRedisReplicas(leaders, followers []redisPodPlacement, current map[string]string, rule placementRule) (map[string]string, bool) {
+	if len(leaders) == 0 {
+		return nil, false
+	}
+	// 先让每个leader分到floor(f/l)个follower, 再分配余下的follower, 每个leader最多多一个;
+	// 增广路径只会替换已分配的follower, 不会减少某个leader的follower个数
+	base := len(followers) / len(leaders)
+	capacity := base
+	followerByName := map[string]redisPodPlacement{}
+	for _, follower := range followers {
+		followerByName[follower.PodName] = follower
+	}
+
+	pairs := map[string]string{}
+	assigned := map[string][]string{}
+	var assign func(follower redisPodPlacement, visited map[string]bool) bool
+	assign = func(follower redisPodPlacement, visited map[string]bool) bool {
+		for _, leader := range orderLeaders(leaders, current[follower.PodName]) {
+			if visited[leader.PodName] || !rule.Match(leader, follower) {
+				continue
+			}
+			visited[leader.PodName] = true
+			if len(assigned[leader.PodName]) < capacity {
+				assigned[leader.PodName] = append(assigned[leader.PodName], follower.PodName)
+				pairs[follower.PodName] = leader.PodName
+				return true
+			}
+			for i, other := range assigned[leader.PodName] {
+				if assign(followerByName[other], visited) {
+					assigned[leader.PodName][i] = follower.PodName
+					pairs[follower.PodName] = leader.PodName
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	var pending []redisPodPlacement
+	for _, follower := range followers {
+		if !assign(follower, map[string]bool{}) {
+			pending = append(pending, follower)
+		}
+	}
+	if len(pairs) != base*len(leaders) {
+		return nil, false
+	}
+	capacity = base + 1
+	for _, follower := range pending {
+		if !assign(follower, map[string]bool{}) {
+			return nil, false
+		}
+	}
+	return pairs, true
+}
+
+// isRedisReplicaBalanced 每个master的副本个数最多相差一个
+func isRedisReplicaBalanced(masters, replicas []redisPodPlacement, current map[string]string) bool {
+	count := map[string]int{}
+	for _, replica := range replicas {
+		count[current[replica.PodName]]++
+	}
+	base := len(replicas) / len(masters)
+	for _, master := range masters {
+		if count[master.PodName] < base || count[master.PodName] > base+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// orderLeaders 把当前的master排在最前面，减少不必要的主从切换
+func orderLeaders(leaders []redisPodPlacement, currentLeader string) []redisPodPlacement {
+	if currentLeader == "" {
+		return leaders
+	}
+	ordered := make([]redisPodPlacement, 0, len(leaders))
+	for _, leader := range leaders {
+		if leader.PodName == currentLeader {
+			ordered = append([]redisPodPlacement{leader}, ordered...)
+		} else {
+			ordered = append(ordered, leader)
+		}
+	}
+	return ordered
+}
+
+// generateRedisReplicaPairs 生成follower到leader的分配方案，返回方案以及满足的规则
+func generateRedisReplicaPairs(leaders, followers []redisPodPlacement, current map[string]string) (map[string]string, placementRule) {
+	for _, rule := range placementRules {
+		if pairs, ok := matchRedisReplicas(leaders, followers, current, rule); ok {
+			return pairs, rule
+		}
+	}
+	return nil, placementRule{}
+}
+
+// getRedisNodeIP 从cluster nodes的地址字段(ip:port@cport)中解析ip
+func getRedisNodeIP(address string) string {
+	address = strings.Split(address, "@")[0]
+	if idx := strings.LastIndex(address, ":"); idx >= 0 {
+		address = address[:idx]
+	}
+	return strings.Trim(address, "[]")
+}
+
+// getRedisNodeByIP 根据ip查找cluster nodes中的节点记录
+func getRedisNodeByIP(nodeList [][]string, ip string) []string {
+	ip = strings.Trim(ip, "[]")
+	for _, node := range nodeList {
+		if len(node) > 1 && getRedisNodeIP(node[1]) == ip {
+			return node
+		}
+	}
+	return nil
+}
+
+// ReconcileRedisReplicaPlacement 检查主从是否在同一节点或可用区，拓扑变化后重新分配follower,
+// 返回重新分配的follower个数以及分配满足的规则, 无法判断时规则为空
+func ReconcileRedisReplicaPlacement(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (int, string, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	var pods []redisPodPlacement
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		placements, err := getRedisPodPlacements(ctx, cr, role, cl)
+		if err != nil {
+			return 0, "", err
+		}
+		pods = append(pods, placements...)
+	}
+
+	// 以集群中的实际角色为准，故障切换后leader pod可能是slave
+	nodes, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return 0, "", err
+	}
+	nodeIDByPod := map[string]string{}
+	podByNodeID := map[string]redisPodPlacement{}
+	var masters, replicas []redisPodPlacement
+	current := map[string]string{}
+	for _, pod := range pods {
+		node := getRedisNodeByIP(nodes, pod.IP)
+		if node == nil || len(node) < 4 {
+			continue
+		}
+		nodeIDByPod[pod.PodName] = node[0]
+		podByNodeID[node[0]] = pod
+		if strings.Contains(node[2], "master") {
+			masters = append(masters, pod)
+		} else if strings.Contains(node[2], "slave") {
+			replicas = append(replicas, pod)
+		}
+	}
+	for _, replica := range replicas {
+		node := getRedisNodeByIP(nodes, replica.IP)
+		if master, ok := podByNodeID[node[3]]; ok {
+			current[replica.PodName] = master.PodName
+		}
+	}
+	if len(masters) == 0 || len(replicas) == 0 {
+		return 0, "", nil
+	}
+
+	pairs, rule := generateRedisReplicaPairs(masters, replicas, current)
+	if pairs == nil {
+		return 0, "", nil
+	}
+	if rule.Name != RedisPlacementNodeAndZone {
+		logger.Info("redis replica placement falls back to a weaker rule", "rule", rule.Name)
+	}
+	masterByName := map[string]redisPodPlacement{}
+	for _, master := range masters {
+		masterByName[master.PodName] = master
+	}
+	violated := !isRedisReplicaBalanced(masters, replicas, current)
+	for _, replica := range replicas {
+		master, ok := masterByName[current[replica.PodName]]
+		if !ok || !rule.Match(master, replica) {
+			violated = true
+			break
+		}
+	}
+	if !violated {
+		logger.Info("redis replica placement is already in-sync")
+		return 0, rule.Name, nil
+	}
+
+	repaired := 0
+	for _, replica := range replicas {
+		masterName := pairs[replica.PodName]
+		if masterName == current[replica.PodName] {
+			continue
+		}
+		logger.Info("re-pairing redis replica", "replica", replica.PodName, "from", current[replica.PodName], "to", masterName)
+		redisClient, err := configureRedisClient(ctx, cr, replica.PodName, cl)
+		if err != nil {
+			return repaired, rule.Name, err
+		}
+		err = redisClient.ClusterReplicate(nodeIDByPod[masterName]).Err()
+		redisClient.Close()
+		observeRedisClusterOperation(cr, redisOperationRepair, err)
+		if err != nil {
+			logger.Error(err, "redis cluster replicate failed", "replica", replica.PodName)
+			return repaired, rule.Name, err
+		}
+		repaired++
+	}
+	return repaired, rule.Name, nil
+}
+
+// ReconcileRedisMasterZones 配置了topology时检查master在各可用区的分布, 某个可用区的master超过平均数时,
+// 在master较少的可用区中选一个它的slave执行CLUSTER FAILOVER; 一个可用区的master过半时该可用区故障后无法完成故障切换.
+// 每次只切换一个master, 切换结果由ReconcileRedisClusterFailover检查, 返回发起切换的个数
+func ReconcileRedisMasterZones(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (int, error) {
+	if cr.Spec.Topology == nil {
+		return 0, nil
+	}
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	var pods []redisPodPlacement
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		placements, err := getRedisPodPlacements(ctx, cr, role, cl)
+		if err != nil {
+			return 0, err
+		}
+		pods = append(pods, placements...)
+	}
+	nodes, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return 0, err
+	}
+
+	masterCount := map[string]int{}
+	var masters []redisPodPlacement
+	replicasByMaster := map[string][]redisPodPlacement{}
+	for _, pod := range pods {
+		if pod.Zone == "" {
+			logger.Info("zone of redis pod is unknown, skip balancing masters", "pod", pod.PodName)
+			return 0, nil
+		}
+		if _, ok := masterCount[pod.Zone]; !ok {
+			masterCount[pod.Zone] = 0
+		}
+		node := getRedisNodeByIP(nodes, pod.IP)
+		if node == nil || len(node) < 4 {
+			continue
+		}
+		if strings.Contains(node[2], "master") {
+			masters = append(masters, pod)
+			masterCount[pod.Zone]++
+		} else if strings.Contains(node[2], "slave") && !strings.Contains(node[2], "fail") {
+			replicasByMaster[node[3]] = append(replicasByMaster[node[3]], pod)
+		}
+	}
+	if len(masterCount) < 2 || len(masters) == 0 {
+		return 0, nil
+	}
+	limit := (len(masters) + len(masterCount) - 1) / len(masterCount)
+
+	for _, master := range masters {
+		if masterCount[master.Zone] <= limit {
+			continue
+		}
+		node := getRedisNodeByIP(nodes, master.IP)
+		var target *redisPodPlacement
+		for i, replica := range replicasByMaster[node[0]] {
+			if masterCount[replica.Zone]+1 > limit {
+				continue
+			}
+			if target == nil || masterCount[replica.Zone] < masterCount[target.Zone] {
+				target = &replicasByMaster[node[0]][i]
+			}
+		}
+		if target == nil {
+			continue
+		}
+		logger.Info("moving redis master to balance zones", "master", master.PodName, "zone", master.Zone,
+			"replica", target.PodName, "targetZone", target.Zone)
+		err := startRedisClusterFailover(ctx, cr, target.IP, cl)
+		observeRedisClusterOperation(cr, redisOperationRepair, err)
+		if err != nil {
+			logger.Error(err, "redis cluster failover failed", "replica", target.PodName)
+			return 0, err
+		}
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,316 @@
+package k8sutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+// placements 按"pod/node/zone"生成pod的拓扑信息
+func placements(specs ...[3]string) []redisPodPlacement {
+	var res []redisPodPlacement
+	for _, spec := range specs {
+		res = append(res, redisPodPlacement{PodName: spec[0], Node: spec[1], Zone: spec[2]})
+	}
+	return res
+}
+
+// replicaCounts 统计每个leader分到的follower个数
+func replicaCounts(pairs map[string]string) map[string]int {
+	res := map[string]int{}
+	for _, leader := range pairs {
+		res[leader]++
+	}
+	return res
+}
+
+func TestMatchRedisReplicas(t *testing.T) {
+	leaders := placements(
+		[3]string{"leader-0", "node-a", "zone-a"},
+		[3]string{"leader-1", "node-b", "zone-b"},
+		[3]string{"leader-2", "node-c", "zone-c"},
+	)
+	tests := []struct {
+		name      string
+		leaders   []redisPodPlacement
+		followers []redisPodPlacement
+		current   map[string]string
+		rule      placementRule
+		ok        bool
+		pairs     map[string]string
+	}{
+		{
+			name:    "one follower per leader in other zones",
+			leaders: leaders,
+			followers: placements(
+				[3]string{"follower-0", "node-b", "zone-b"},
+				[3]string{"follower-1", "node-c", "zone-c"},
+				[3]string{"follower-2", "node-a", "zone-a"},
+			),
+			rule: placementRules[0],
+			ok:   true,
+		},
+		{
+			name:    "four followers never leave a leader without replica",
+			leaders: leaders,
+			followers: placements(
+				[3]string{"follower-0", "node-b", "zone-b"},
+				[3]string{"follower-1", "node-b", "zone-b"},
+				[3]string{"follower-2", "node-a", "zone-a"},
+				[3]string{"follower-3", "node-a", "zone-a"},
+			),
+			rule: placementRules[0],
+			ok:   true,
+		},
+		{
+			name:    "current pairs are kept when they satisfy the rule",
+			leaders: leaders,
+			followers: placements(
+				[3]string{"follower-0", "node-b", "zone-b"},
+				[3]string{"follower-1", "node-c", "zone-c"},
+				[3]string{"follower-2", "node-a", "zone-a"},
+			),
+			current: map[string]string{"follower-0": "leader-2", "follower-1": "leader-0", "follower-2": "leader-1"},
+			rule:    placementRules[0],
+			ok:      true,
+			pairs:   map[string]string{"follower-0": "leader-2", "follower-1": "leader-0", "follower-2": "leader-1"},
+		},
+		{
+			name:    "all followers in one zone cannot avoid the zone",
+			leaders: leaders,
+			followers: placements(
+				[3]string{"follower-0", "node-d", "zone-a"},
+				[3]string{"follower-1", "node-e", "zone-a"},
+				[3]string{"follower-2", "node-f", "zone-a"},
+			),
+			rule: placementRules[0],
+			ok:   false,
+		},
+		{
+			name:    "more leaders than followers",
+			leaders: leaders,
+			followers: placements(
+				[3]string{"follower-0", "node-b", "zone-b"},
+			),
+			rule: placementRules[0],
+			ok:   true,
+		},
+		{
+			name: "no leaders",
+			followers: placements(
+				[3]string{"follower-0", "node-b", "zone-b"},
+			),
+			rule: placementRules[0],
+			ok:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, ok := matchRedisReplicas(tt.leaders, tt.followers, tt.current, tt.rule)
+			if ok != tt.ok {
+				t.Fatalf("ok = %v, want %v, pairs %v", ok, tt.ok, pairs)
+			}
+			if !ok {
+				return
+			}
+			if len(pairs) != len(tt.followers) {
+				t.Fatalf("%d followers paired, want %d: %v", len(pairs), len(tt.followers), pairs)
+			}
+			leaderByName := map[string]redisPodPlacement{}
+			for _, leader := range tt.leaders {
+				leaderByName[leader.PodName] = leader
+			}
+			for _, follower := range tt.followers {
+				if !tt.rule.Match(leaderByName[pairs[follower.PodName]], follower) {
+					t.Errorf("%s paired with %s violates rule %s", follower.PodName, pairs[follower.PodName], tt.rule.Name)
+				}
+			}
+			//每个leader的副本个数为floor(f/l)或多一个
+			counts := replicaCounts(pairs)
+			base := len(tt.followers) / len(tt.leaders)
+			for _, leader := range tt.leaders {
+				if counts[leader.PodName] < base || counts[leader.PodName] > base+1 {
+					t.Errorf("%s has %d replicas, want %d or %d: %v", leader.PodName, counts[leader.PodName], base, base+1, pairs)
+				}
+			}
+			for follower, leader := range tt.pairs {
+				if pairs[follower] != leader {
+					t.Errorf("%s paired with %s, want %s", follower, pairs[follower], leader)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateRedisReplicaPairs(t *testing.T) {
+	tests := []struct {
+		name      string
+		leaders   []redisPodPlacement
+		followers []redisPodPlacement
+		rule      string
+	}{
+		{
+			name: "node and zone",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-a"},
+				[3]string{"leader-1", "node-b", "zone-b"},
+			),
+			followers: placements(
+				[3]string{"follower-0", "node-a", "zone-a"},
+				[3]string{"follower-1", "node-b", "zone-b"},
+			),
+			rule: RedisPlacementNodeAndZone,
+		},
+		{
+			name: "nodes without zone labels",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", ""},
+				[3]string{"leader-1", "node-b", ""},
+			),
+			followers: placements(
+				[3]string{"follower-0", "node-a", ""},
+				[3]string{"follower-1", "node-b", ""},
+			),
+			rule: RedisPlacementNodeAndZone,
+		},
+		{
+			name: "single zone falls back to node",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-a"},
+				[3]string{"leader-1", "node-b", "zone-a"},
+			),
+			followers: placements(
+				[3]string{"follower-0", "node-a", "zone-a"},
+				[3]string{"follower-1", "node-b", "zone-a"},
+			),
+			rule: RedisPlacementNode,
+		},
+		{
+			name: "single node falls back to any",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-a"},
+				[3]string{"leader-1", "node-a", "zone-a"},
+			),
+			followers: placements(
+				[3]string{"follower-0", "node-a", "zone-a"},
+				[3]string{"follower-1", "node-a", "zone-a"},
+			),
+			rule: RedisPlacementAny,
+		},
+		{
+			name: "no leaders",
+			followers: placements(
+				[3]string{"follower-0", "node-a", "zone-a"},
+			),
+			rule: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, rule := generateRedisReplicaPairs(tt.leaders, tt.followers, nil)
+			if rule.Name != tt.rule {
+				t.Fatalf("rule = %q, want %q", rule.Name, tt.rule)
+			}
+			if tt.rule == "" {
+				if pairs != nil {
+					t.Fatalf("pairs = %v, want nil", pairs)
+				}
+				return
+			}
+			if len(pairs) != len(tt.followers) {
+				t.Fatalf("%d followers paired, want %d: %v", len(pairs), len(tt.followers), pairs)
+			}
+		})
+	}
+}
+
+func TestIsRedisReplicaBalanced(t *testing.T) {
+	masters := placements(
+		[3]string{"leader-0", "node-a", "zone-a"},
+		[3]string{"leader-1", "node-b", "zone-b"},
+		[3]string{"leader-2", "node-c", "zone-c"},
+	)
+	replicas := placements(
+		[3]string{"follower-0", "node-b", "zone-b"},
+		[3]string{"follower-1", "node-c", "zone-c"},
+		[3]string{"follower-2", "node-a", "zone-a"},
+		[3]string{"follower-3", "node-a", "zone-a"},
+	)
+	tests := []struct {
+		name    string
+		current map[string]string
+		want    bool
+	}{
+		{
+			name:    "2/1/1",
+			current: map[string]string{"follower-0": "leader-0", "follower-1": "leader-0", "follower-2": "leader-1", "follower-3": "leader-2"},
+			want:    true,
+		},
+		{
+			name:    "2/2/0",
+			current: map[string]string{"follower-0": "leader-0", "follower-1": "leader-0", "follower-2": "leader-1", "follower-3": "leader-1"},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRedisReplicaBalanced(masters, replicas, tt.current); got != tt.want {
+				t.Errorf("isRedisReplicaBalanced() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderRedisLeadersByZone(t *testing.T) {
+	tests := []struct {
+		name    string
+		leaders []redisPodPlacement
+		want    []string
+	}{
+		{
+			name: "round robin over sorted zones",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-b"},
+				[3]string{"leader-1", "node-b", "zone-a"},
+				[3]string{"leader-2", "node-c", "zone-c"},
+			),
+			want: []string{"leader-1", "leader-0", "leader-2"},
+		},
+		{
+			name: "uneven zones",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-a"},
+				[3]string{"leader-1", "node-b", "zone-a"},
+				[3]string{"leader-2", "node-c", "zone-a"},
+				[3]string{"leader-3", "node-d", "zone-b"},
+			),
+			want: []string{"leader-0", "leader-3", "leader-1", "leader-2"},
+		},
+		{
+			name: "single zone keeps order",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", "zone-a"},
+				[3]string{"leader-1", "node-b", "zone-a"},
+			),
+			want: []string{"leader-0", "leader-1"},
+		},
+		{
+			name: "pods without zone label",
+			leaders: placements(
+				[3]string{"leader-0", "node-a", ""},
+				[3]string{"leader-1", "node-b", "zone-a"},
+				[3]string{"leader-2", "node-c", ""},
+			),
+			want: []string{"leader-0", "leader-1", "leader-2"},
+		},
+		{
+			name: "no leaders",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := orderRedisLeadersByZone(tt.leaders); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("orderRedisLeadersByZone() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
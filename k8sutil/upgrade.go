@@ -0,0 +1,242 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// RedisFailoverAnnotation 执行CLUSTER FAILOVER的slave pod上记录开始时间, 提升为master后删除
+	RedisFailoverAnnotation = "redis.yylover.failover-started"
+
+	failoverTimeout = time.Minute
+)
+
+// redisUpgradePod 需要升级到statefulSet最新版本的pod
+type redisUpgradePod struct {
+	PodName string
+	IP      string
+}
+
+// getRedisClusterOutdatedPods 获取版本落后于statefulSet updateRevision的pod,
+// 有pod未就绪时返回ready为false, 等待上一步升级完成
+func getRedisClusterOutdatedPods(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (outdated []redisUpgradePod, ready bool, err error) {
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		statefulName := cr.Name + "-" + role
+		sts, err := GetStateFulSet(ctx, cr.Namespace, statefulName, cl)
+		if err != nil {
+			return nil, false, err
+		}
+		if sts.Status.UpdateRevision == "" {
+			continue
+		}
+		pods := &corev1.PodList{}
+		err = cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"app": statefulName, "role": role})
+		if err != nil {
+			return nil, false, err
+		}
+		if len(pods.Items) != int(sts.Status.Replicas) {
+			return nil, false, nil
+		}
+		for _, pod := range pods.Items {
+			if pod.DeletionTimestamp != nil || !IsPodReady(&pod) {
+				return nil, false, nil
+			}
+			if pod.Labels[appsv1.StatefulSetRevisionLabel] != sts.Status.UpdateRevision {
+				outdated = append(outdated, redisUpgradePod{PodName: pod.Name, IP: pod.Status.PodIP})
+			}
+		}
+	}
+	sort.Slice(outdated, func(i, j int) bool {
+		return outdated[i].PodName < outdated[j].PodName
+	})
+	return outdated, true, nil
+}
+
+// IsPodReady 判断pod是否就绪
+func IsPodReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ReconcileRedisClusterUpgrade statefulSet使用OnDelete策略, 由operator按集群中的实际角色滚动升级:
+// 先重启slave, 再对每个master在其slave上执行CLUSTER FAILOVER, 切换完成后旧的master作为slave重启;
+// 每次只重启一个pod, 返回是否仍在升级中
+func ReconcileRedisClusterUpgrade(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (bool, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	outdated, ready, err := getRedisClusterOutdatedPods(ctx, cr, cl)
+	if err != nil {
+		logger.Error(err, "get outdated redis pods failed")
+		return false, err
+	}
+	if !ready {
+		logger.Info("redis cluster pods are not ready, waiting")
+		return true, nil
+	}
+	if len(outdated) == 0 {
+		return false, nil
+	}
+
+	nodes, err := checkRedisCluster(ctx, cr, cl)
+	if err != nil {
+		return false, err
+	}
+	var masters []redisUpgradePod
+	for _, pod := range outdated {
+		node := getRedisNodeByIP(nodes, pod.IP)
+		if node == nil || len(node) < 3 || !strings.Contains(node[2], "master") {
+			logger.Info("upgrading redis replica", "pod", pod.PodName)
+			return true, deleteRedisPod(ctx, cr.Namespace, pod.PodName, cl)
+		}
+		masters = append(masters, pod)
+	}
+
+	master := masters[0]
+	masterID := getRedisNodeByIP(nodes, master.IP)[0]
+	replica := getRedisClusterReplica(nodes, masterID)
+	if replica == nil {
+		logger.Info("redis master has no healthy replica, restarting without failover", "pod", master.PodName)
+		return true, deleteRedisPod(ctx, cr.Namespace, master.PodName, cl)
+	}
+
+	//切换完成后旧的master成为slave, 之后按slave升级
+	replicaIP := getRedisNodeIP(replica[1])
+	logger.Info("failover redis master before upgrade", "pod", master.PodName, "replica", replicaIP)
+	if err := startRedisClusterFailover(ctx, cr, replicaIP, cl); err != nil {
+		logger.Error(err, "redis cluster failover failed", "pod", master.PodName, "replica", replicaIP)
+		return true, err
+	}
+	return true, nil
+}
+
+// startRedisClusterFailover 在slave上执行CLUSTER FAILOVER, 并在pod上记录开始时间, 由ReconcileRedisClusterFailover检查结果
+func startRedisClusterFailover(ctx context.Context, cr *v1alpha1.RedisCluster, replicaIP string, cl client.Client) error {
+	redisClient := newRedisClient(generateRedisAddr(replicaIP, redisPort))
+	defer redisClient.Close()
+	if err := redisClient.ClusterFailover().Err(); err != nil {
+		return err
+	}
+	pods, err := listRedisClusterPods(ctx, cr, cl)
+	if err != nil {
+		return err
+	}
+	for i := range pods {
+		if pods[i].Status.PodIP == replicaIP {
+			return patchRedisPodAnnotation(ctx, &pods[i], RedisFailoverAnnotation, time.Now().UTC().Format(time.RFC3339), cl)
+		}
+	}
+	return nil
+}
+
+// ReconcileRedisClusterFailover 检查执行中的CLUSTER FAILOVER, slave提升为master或超时后删除pod上的记录;
+// 返回是否仍有未完成的切换
+func ReconcileRedisClusterFailover(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) (bool, error) {
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	pods, err := listRedisClusterPods(ctx, cr, cl)
+	if err != nil {
+		return false, err
+	}
+	pending := false
+	for i := range pods {
+		pod := &pods[i]
+		value := pod.Annotations[RedisFailoverAnnotation]
+		if value == "" || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			continue
+		}
+		promoted, err := isRedisPodMaster(pod.Status.PodIP)
+		if err != nil {
+			return false, err
+		}
+		started, parseErr := time.Parse(time.RFC3339, value)
+		if !promoted && parseErr == nil && time.Since(started) < failoverTimeout {
+			pending = true
+			continue
+		}
+		if err := patchRedisPodAnnotation(ctx, pod, RedisFailoverAnnotation, "", cl); err != nil {
+			return false, err
+		}
+		if !promoted {
+			return false, fmt.Errorf("redis replica %s not promoted in %s", pod.Name, failoverTimeout)
+		}
+		logger.Info("redis replica promoted to master", "pod", pod.Name)
+	}
+	return pending, nil
+}
+
+// isRedisPodMaster 判断pod上的redis节点是否为master
+func isRedisPodMaster(ip string) (bool, error) {
+	redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+	defer redisClient.Close()
+	return redisNodeIsMaster(redisClient)
+}
+
+// getRedisClusterReplica 在CLUSTER NODES中查找master下连接正常的slave
+func getRedisClusterReplica(nodes [][]string, masterID string) []string {
+	for _, node := range nodes {
+		if len(node) < 8 || node[3] != masterID {
+			continue
+		}
+		if strings.Contains(node[2], "slave") && !strings.Contains(node[2], "fail") && node[7] == "connected" {
+			return node
+		}
+	}
+	return nil
+}
+
+// redisNodeIsMaster 判断CLUSTER NODES输出中当前节点(myself)是否为master
+func redisNodeIsMaster(redisClient *redis.Client) (bool, error) {
+	nodes, err := redisClient.ClusterNodes().Result()
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(nodes, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && strings.Contains(fields[2], "myself") {
+			return strings.Contains(fields[2], "master"), nil
+		}
+	}
+	return false, nil
+}
+
+// patchRedisPodAnnotation 设置pod的注解, value为空时删除
+func patchRedisPodAnnotation(ctx context.Context, pod *corev1.Pod, key, value string, cl client.Client) error {
+	if pod.Annotations[key] == value {
+		return nil
+	}
+	patch := client.MergeFrom(pod.DeepCopy())
+	if value == "" {
+		delete(pod.Annotations, key)
+	} else {
+		if pod.Annotations == nil {
+			pod.Annotations = map[string]string{}
+		}
+		pod.Annotations[key] = value
+	}
+	return cl.Patch(ctx, pod, patch)
+}
+
+// deleteRedisPod 删除pod, OnDelete策略下statefulSet会用新版本重建
+func deleteRedisPod(ctx context.Context, namespace, podName string, cl client.Client) error {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: podName}}
+	err := cl.Delete(ctx, pod)
+	if err != nil && !errors.IsNotFound(err) {
+		generateRedisManagerLogger(namespace, podName).Error(err, "delete redis pod failed")
+		return err
+	}
+	return nil
+}
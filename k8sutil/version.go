@@ -0,0 +1,186 @@
+package k8sutil
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yylover/memcached-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	redisACLVolumeName = "redis-acl"
+	redisACLPath       = "/etc/redis/acl"
+	redisACLFile       = redisACLPath + "/users.acl"
+	redisAOFDirName    = "appendonlydir"
+)
+
+// parseRedisVersion 把redis_version解析为[major, minor, patch], 无法解析时返回nil
+func parseRedisVersion(version string) []int {
+	parts := strings.SplitN(version, ".", 3)
+	res := make([]int, 0, 3)
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil
+		}
+		res = append(res, n)
+	}
+	for len(res) < 3 {
+		res = append(res, 0)
+	}
+	return res
+}
+
+// compareRedisVersion 比较两个版本, a小于、等于、大于b时分别返回-1、0、1
+func compareRedisVersion(a, b string) int {
+	va, vb := parseRedisVersion(a), parseRedisVersion(b)
+	for i := 0; i < len(va) && i < len(vb); i++ {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// isRedis7 检测到的版本是否为7.x及以上, 未检测到版本时按6.x处理
+func isRedis7(version string) bool {
+	v := parseRedisVersion(version)
+	return v != nil && v[0] >= 7
+}
+
+// generateRedisVersionConfig 7.x使用ACL文件保存用户, AOF固定写入多文件的appendonlydir目录
+func generateRedisVersionConfig(version string) map[string]string {
+	res := map[string]string{}
+	if isRedis7(version) {
+		res["aclfile"] = redisACLFile
+		res["appenddirname"] = redisAOFDirName
+	}
+	return res
+}
+
+// detectRedisVersion 执行INFO server获取就绪pod的redis_version, 取最低的版本, 滚动升级时按旧版本渲染配置;
+// 没有就绪的pod时返回空
+func detectRedisVersion(ctx context.Context, namespace string, statefulNames []string, cl client.Client) (string, error) {
+	version := ""
+	for _, statefulName := range statefulNames {
+		pods, err := getReadyRedisPods(ctx, namespace, statefulName, cl)
+		if err != nil {
+			return "", err
+		}
+		for podName, ip := range pods {
+			redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+			info, err := getRedisInfo(redisClient, "server")
+			redisClient.Close()
+			if err != nil {
+				return "", fmt.Errorf("get redis version of %s: %v", podName, err)
+			}
+			current := info["redis_version"]
+			if parseRedisVersion(current) == nil {
+				continue
+			}
+			if version == "" || compareRedisVersion(current, version) < 0 {
+				version = current
+			}
+		}
+	}
+	return version, nil
+}
+
+// DetectRedisSingleVersion 检测单例的redis版本写入status, 没有就绪的pod时保留之前的结果
+func DetectRedisSingleVersion(ctx context.Context, cr *v1alpha1.RedisSingle, cl client.Client) error {
+	version, err := detectRedisVersion(ctx, cr.Namespace, []string{cr.Name}, cl)
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		cr.Status.RedisVersion = version
+	}
+	return nil
+}
+
+// DetectRedisClusterVersion 检测集群leader和follower中最低的redis版本写入status
+func DetectRedisClusterVersion(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	version, err := detectRedisVersion(ctx, cr.Namespace, []string{cr.Name + "-" + ClusterRoleLeader, cr.Name + "-" + ClusterRoleFollower}, cl)
+	if err != nil {
+		return err
+	}
+	if version != "" {
+		cr.Status.RedisVersion = version
+	}
+	return nil
+}
+
+// useRedisClusterHostnames 7.x集群通过headless service的域名互相访问, 开启对外访问时仍然使用announce的ip
+func useRedisClusterHostnames(cr *v1alpha1.RedisCluster) bool {
+	return isRedis7(cr.Status.RedisVersion) && !isRedisClusterExternal(cr)
+}
+
+// generateRedisPodHostname pod在headless service下的域名
+func generateRedisPodHostname(podName, statefulName, namespace string) string {
+	return fmt.Sprintf("%s.%s-headless.%s.svc", podName, statefulName, namespace)
+}
+
+// ReconcileRedisClusterHostnames 7.x集群在每个就绪的pod上设置cluster-announce-hostname, 并把首选的地址类型设置为hostname;
+// 两个参数都是在线修改, 重启后的pod在设置之前仍然使用ip, 不会返回没有hostname的地址.
+// 只有subdomain是headless service的pod域名可以解析, 旧statefulSet创建的pod重建前继续使用ip
+func ReconcileRedisClusterHostnames(ctx context.Context, cr *v1alpha1.RedisCluster, cl client.Client) error {
+	//开启对外访问时announce的域名由ReconcileRedisClusterExternalAccess设置
+	if !isRedis7(cr.Status.RedisVersion) || isRedisClusterExternal(cr) {
+		return nil
+	}
+	logger := generateRedisManagerLogger(cr.Namespace, cr.Name)
+	hostnames := useRedisClusterHostnames(cr)
+	for _, role := range []string{ClusterRoleLeader, ClusterRoleFollower} {
+		statefulName := cr.Name + "-" + role
+		pods := &corev1.PodList{}
+		if err := cl.List(ctx, pods, client.InNamespace(cr.Namespace), client.MatchingLabels{"app": statefulName}); err != nil {
+			return err
+		}
+		for i := range pods.Items {
+			pod := &pods.Items[i]
+			if pod.Status.PodIP == "" || pod.DeletionTimestamp != nil || !IsPodReady(pod) {
+				continue
+			}
+			config := map[string]string{"cluster-announce-hostname": "", "cluster-preferred-endpoint-type": "ip"}
+			if hostnames && pod.Spec.Subdomain == statefulName+"-headless" {
+				config["cluster-announce-hostname"] = generateRedisPodHostname(pod.Name, statefulName, cr.Namespace)
+				config["cluster-preferred-endpoint-type"] = "hostname"
+			}
+			if err := applyRedisHostnameConfig(pod.Status.PodIP, config); err != nil {
+				logger.Error(err, "set redis cluster announce hostname failed", "pod", pod.Name)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyRedisHostnameConfig 开启时先设置hostname再切换地址类型, 关闭时顺序相反, 和当前值一致时跳过
+func applyRedisHostnameConfig(ip string, config map[string]string) error {
+	redisClient := newRedisClient(generateRedisAddr(ip, redisPort))
+	defer redisClient.Close()
+	names := []string{"cluster-announce-hostname", "cluster-preferred-endpoint-type"}
+	if config["cluster-preferred-endpoint-type"] == "ip" {
+		names[0], names[1] = names[1], names[0]
+	}
+	for _, name := range names {
+		current, err := getRedisConfig(redisClient, name)
+		if err != nil {
+			return err
+		}
+		if current == config[name] {
+			continue
+		}
+		if err := redisClient.ConfigSet(name, config[name]).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}